@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/GenM4/penguin/pkg/generator"
+	"github.com/GenM4/penguin/pkg/module"
+	"github.com/GenM4/penguin/pkg/project"
+	"github.com/GenM4/penguin/pkg/utils/files"
+)
+
+// Version is set when building a release with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// Options control how far a program is built and where its artifacts go
+type Options struct {
+	Output         string          // path of the final artifact
+	OutDir         string          // directory the artifacts are written to, overriding that of the project
+	AsmOnly        bool            // stop after generating assembly
+	ObjOnly        bool            // stop after assembling the object
+	KeepTemps      bool            // keep the assembly and object next to the artifact instead of in a temporary directory
+	NoBoundsChecks bool            // leave out the runtime checks on array indices
+	Emit           map[string]bool // intermediate representations to write out, see EmitKinds
+	EmitDir        string          // directory they are written to instead of stdout
+	TokenKinds     bool            // show the kind of every emitted token
+	Verbose        bool            // log each stage of the build
+}
+
+const usage = `usage: penguin <command> [flags] [file.pn | dir]
+
+Commands:
+  build    compile a file, or the project whose penguin.json is in dir or above it
+  run      build and run the program, passing it the arguments after --
+  check    parse and type-check without generating code
+  version  print the compiler version
+
+The compiler is silent on success unless -v is given. --emit writes intermediate
+representations to stdout, or to files named after the program in --emit-dir.
+
+Without a file or dir, the project of the current directory is used.
+'penguin file.pn' is short for 'penguin build file.pn'.
+
+Flags:
+`
+
+// Main runs the command given by args and returns the exit code
+func Main(args []string) int {
+	if len(args) == 0 {
+		printUsage(newFlagSet(&Options{}))
+		return 2
+	}
+
+	command := args[0]
+	if strings.HasSuffix(command, module.Extension) {
+		command = "build"
+	} else {
+		args = args[1:]
+	}
+
+	// arguments after -- are passed to the program by run
+	var programArgs []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, programArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	var opts Options
+	flags := newFlagSet(&opts)
+	targets, err := parseFlags(flags, args)
+	if err != nil {
+		return 2
+	}
+
+	if opts.AsmOnly && opts.ObjOnly {
+		fmt.Fprintln(os.Stderr, "penguin: -S and -c cannot be combined")
+		return 2
+	} else if len(targets) > 1 {
+		fmt.Fprintln(os.Stderr, "penguin: expected one file or dir, got", strings.Join(targets, " "))
+		return 2
+	} else if len(programArgs) > 0 && command != "run" {
+		fmt.Fprintln(os.Stderr, "penguin: only run passes arguments to the program")
+		return 2
+	}
+
+	target := "."
+	if len(targets) == 1 {
+		target = targets[0]
+	}
+
+	if !opts.Verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	switch command {
+	case "build":
+		proj := loadTarget(target)
+		Compile(outputFilepaths(proj, opts), proj, opts)
+	case "run":
+		if opts.AsmOnly || opts.ObjOnly {
+			fmt.Fprintln(os.Stderr, "penguin: run cannot be combined with -S or -c")
+			return 2
+		}
+
+		proj := loadTarget(target)
+		fileData := outputFilepaths(proj, opts)
+		if Compile(fileData, proj, opts) != fileData.ExecFilepath {
+			panic(fmt.Errorf("%v has no main to run", proj.Entry))
+		}
+
+		return Run(fileData.ExecFilepath, programArgs)
+	case "check":
+		ParseProgram(loadTarget(target), opts, generator.NewRegistry())
+	case "version":
+		fmt.Println("penguin " + Version)
+	default:
+		fmt.Fprintf(os.Stderr, "penguin: unknown command '%v'\n\n", command)
+		printUsage(flags)
+		return 2
+	}
+
+	return 0
+}
+
+func newFlagSet(opts *Options) *flag.FlagSet {
+	flags := flag.NewFlagSet("penguin", flag.ContinueOnError)
+	flags.StringVar(&opts.Output, "o", "", "write the executable, or the `path` asked for by -S or -c, to path")
+	flags.StringVar(&opts.OutDir, "out-dir", "", "write the artifacts to `dir`, creating it if needed")
+	flags.BoolVar(&opts.AsmOnly, "S", false, "only generate assembly")
+	flags.BoolVar(&opts.ObjOnly, "c", false, "only generate an object file")
+	flags.BoolVar(&opts.KeepTemps, "keep-temps", false, "keep the assembly and object files of a linked program")
+	flags.BoolVar(&opts.NoBoundsChecks, "no-bounds-checks", false, "leave out the runtime checks on array indices")
+	flags.Func("emit", "write out the comma separated `kinds` among "+strings.Join(EmitKinds, ","), func(list string) error {
+		return parseEmit(list, opts)
+	})
+	flags.StringVar(&opts.EmitDir, "emit-dir", "", "write what --emit asks for to files in `dir` instead of stdout")
+	flags.BoolVar(&opts.TokenKinds, "token-kinds", false, "show the kind of every token emitted")
+	flags.BoolVar(&opts.Verbose, "v", false, "log each stage of the build")
+	flags.Usage = func() { printUsage(flags) }
+
+	return flags
+}
+
+func printUsage(flags *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, usage)
+	flags.SetOutput(os.Stderr)
+	flags.PrintDefaults()
+}
+
+// parseFlags allows flags before and after the file or dir, returning the arguments that are not flags
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var targets []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() == 0 {
+			return targets, nil
+		}
+
+		targets = append(targets, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// loadTarget reads the project a command applies to, a single file being a project of its own
+func loadTarget(target string) project.Project {
+	info, err := os.Stat(target)
+	if err == nil && !info.IsDir() {
+		return project.Project{Entry: target, Output: strings.TrimSuffix(target, filepath.Ext(target))}
+	}
+
+	// a missing source file is not a directory to search for a project file
+	if err != nil && filepath.Ext(target) == ".pn" {
+		panic(err)
+	}
+
+	path, err := project.Find(target)
+	if err != nil {
+		panic(err)
+	}
+
+	proj, err := project.Load(path)
+	if err != nil {
+		panic(err)
+	}
+
+	return proj
+}
+
+// outputFilepaths names the artifacts of building proj, -o naming whichever is built last
+func outputFilepaths(proj project.Project, opts Options) files.FileData {
+	if opts.OutDir != "" {
+		proj.Output = filepath.Join(opts.OutDir, filepath.Base(proj.Output))
+	}
+
+	if opts.Output == "" {
+		return files.OutputFilepaths(proj.Entry, proj.Output)
+	}
+
+	if !opts.AsmOnly && !opts.ObjOnly {
+		return files.OutputFilepaths(proj.Entry, opts.Output)
+	}
+
+	fileData := files.OutputFilepaths(proj.Entry, strings.TrimSuffix(opts.Output, filepath.Ext(opts.Output)))
+	if opts.AsmOnly {
+		fileData.AsmFilename = filepath.Base(opts.Output)
+		fileData.AsmFilepath = opts.Output
+	} else {
+		fileData.ObjFilename = filepath.Base(opts.Output)
+		fileData.ObjFilepath = opts.Output
+	}
+
+	return fileData
+}
+
+// Run executes a built program with the standard streams of the compiler, returning its exit code
+func Run(path string, args []string) int {
+	// a path without a directory would be looked up in PATH
+	if !strings.Contains(path, string(filepath.Separator)) {
+		path = "." + string(filepath.Separator) + path
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	} else if err != nil {
+		panic(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GenM4/penguin/pkg/parser"
+	"github.com/GenM4/penguin/pkg/project"
+	"github.com/GenM4/penguin/pkg/semantics"
+	"github.com/GenM4/penguin/pkg/tokenizer"
+
+	"github.com/m1gwings/treedrawer/tree"
+)
+
+// EmitKinds are the intermediate representations --emit can write out.
+// The compiler has no IR of its own, ir is the whole typed tree the generator is given, standard library included
+var EmitKinds = []string{"tokens", "ast", "symbols", "ir", "asm"}
+
+// parseEmit reads the comma separated kinds given to --emit
+func parseEmit(list string, opts *Options) error {
+	if opts.Emit == nil {
+		opts.Emit = make(map[string]bool)
+	}
+
+	for _, kind := range strings.Split(list, ",") {
+		known := false
+		for _, emitKind := range EmitKinds {
+			known = known || kind == emitKind
+		}
+
+		if !known {
+			return fmt.Errorf("unknown kind '%v', expected some of %v", kind, strings.Join(EmitKinds, ","))
+		}
+
+		opts.Emit[kind] = true
+	}
+
+	return nil
+}
+
+// emit writes one representation asked for with --emit, to stdout or to a file named after the entry in --emit-dir
+func emit(opts Options, proj project.Project, kind string, write func(out io.Writer)) {
+	if !opts.Emit[kind] {
+		return
+	}
+
+	if opts.EmitDir == "" {
+		fmt.Println(strings.ToUpper(kind) + ":")
+		write(os.Stdout)
+		fmt.Println()
+		return
+	}
+
+	if err := os.MkdirAll(opts.EmitDir, 0755); err != nil {
+		panic(err)
+	}
+
+	base := strings.TrimSuffix(filepath.Base(proj.Entry), filepath.Ext(proj.Entry))
+	file, err := os.Create(filepath.Join(opts.EmitDir, base+"."+kind))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	write(file)
+}
+
+func copyFile(out io.Writer, path string) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+
+	out.Write(dat)
+}
+
+func printTokens(out io.Writer, tokens tokenizer.TokenStack, printKinds bool) {
+	for _, token := range tokens.Tokens {
+		if token.Data == "\n" {
+			fmt.Fprint(out, "\\n\\", "\n")
+		} else {
+			var kind string
+			if printKinds {
+				kind = token.Kind.String() + ":"
+			} else {
+				kind = ""
+			}
+			fmt.Fprint(out, kind+token.Data, "\t")
+		}
+	}
+}
+
+func printAST(out io.Writer, ASTRoot *parser.ASTNode) {
+	t := tree.NewTree(tree.NodeString(formatASTNode(*ASTRoot)))
+	for _, l1Node := range ASTRoot.Children {
+		l1TreeNode := t.AddChild(tree.NodeString(formatASTNode(l1Node)))
+		for _, l2Node := range l1Node.Children {
+			l2TreeNode := l1TreeNode.AddChild(tree.NodeString(formatASTNode(l2Node)))
+			for _, l3Node := range l2Node.Children {
+				l3TreeNode := l2TreeNode.AddChild(tree.NodeString(formatASTNode(l3Node)))
+				for _, l4Node := range l3Node.Children {
+					l4TreeNode := l3TreeNode.AddChild(tree.NodeString(formatASTNode(l4Node)))
+					for _, l5Node := range l4Node.Children {
+						l4TreeNode.AddChild(tree.NodeString(formatASTNode(l5Node)))
+					}
+				}
+			}
+		}
+	}
+	fmt.Fprintln(out, t)
+}
+
+func formatASTNode(node parser.ASTNode) string {
+	switch node.Kind {
+	case parser.Program:
+		return node.Kind.String() + ": " + node.Data
+	case parser.Declaration:
+		return node.Kind.String() + ": " + node.Data + "\n" + "Mutable: " + strconv.FormatBool(node.Mutable) + "\n" + "Type: " + node.Type.String()
+	case parser.Scope:
+		return node.Kind.String() + ": " + "'" + node.Parent.Data + "'"
+	case parser.Statement:
+		return node.Kind.String() + ": " + node.Data
+	case parser.Expression:
+		return node.Kind.String() + ": " + node.Data + "\n" + "Prec: " + strconv.Itoa(node.Precedence)
+	case parser.Identifier:
+		return node.Kind.String() + ": " + node.Data + "\n" + "Type: " + node.Type.String() + "\n" + "Prec: " + strconv.Itoa(node.Precedence)
+	case parser.Term:
+		return node.Kind.String() + ": " + node.Data + "\n" + "Type: " + node.Type.String() + "\n" + "Prec: " + strconv.Itoa(node.Precedence)
+	default:
+		return node.Kind.String() + ": " + node.Data + "\n" + "Type: " + node.Type.String() + "\n"
+	}
+}
+
+// printIR lists every node of the tree on its own line, indented by depth, unlike the AST drawing which stops at five levels
+func printIR(out io.Writer, node parser.ASTNode, depth int) {
+	line := strings.Repeat("  ", depth) + node.Kind.String()
+	if node.Data != "" && node.Kind != parser.Asm {
+		line += " " + strconv.Quote(node.Data)
+	}
+	if node.Type != semantics.Untyped {
+		line += " : " + node.Type.String()
+	}
+	if node.Mutable {
+		line += " mut"
+	}
+	fmt.Fprintln(out, line)
+
+	for _, child := range node.Children {
+		printIR(out, child, depth+1)
+	}
+}
+
+// printSymbols lists the globals and functions of the program with the symbols they are emitted under
+func printSymbols(out io.Writer, vars *semantics.VarMap, funcs *semantics.FuncMap) {
+	var names []string
+	for name := range *vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "globals:")
+	for _, name := range names {
+		variable := (*vars)[name]
+
+		typ := variable.Type.String()
+		if variable.IsArray() {
+			typ += "[" + strconv.Itoa(variable.Length) + "]"
+		}
+
+		fmt.Fprintf(out, "  %v %v mut=%v\n", name, typ, variable.Mutable)
+	}
+
+	names = nil
+	for name := range *funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "functions:")
+	for _, name := range names {
+		function := (*funcs)[name]
+
+		var params []string
+		for _, param := range function.Params {
+			params = append(params, strings.TrimSpace(param.Type.String()+" "+param.Name))
+		}
+
+		var flags []string
+		for flag, set := range map[string]bool{"builtin": function.Builtin, "extern": function.Extern, "export": function.Exported, "library": function.Library, "pub": function.Public} {
+			if set {
+				flags = append(flags, flag)
+			}
+		}
+		sort.Strings(flags)
+
+		line := fmt.Sprintf("  %v(%v) %v %v %v", name, strings.Join(params, ", "), function.Type.String(), function.Signature, strings.Join(flags, " "))
+		fmt.Fprintln(out, strings.TrimRight(line, " "))
+	}
+}
@@ -2,42 +2,102 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
-	"strconv"
+	"path/filepath"
 
 	"github.com/GenM4/penguin/pkg/generator"
+	"github.com/GenM4/penguin/pkg/module"
 	"github.com/GenM4/penguin/pkg/parser"
+	"github.com/GenM4/penguin/pkg/project"
 	"github.com/GenM4/penguin/pkg/semantics"
+	"github.com/GenM4/penguin/pkg/std"
 	"github.com/GenM4/penguin/pkg/tokenizer"
 	"github.com/GenM4/penguin/pkg/utils/files"
-
-	"github.com/m1gwings/treedrawer/tree"
 )
 
-var PRINT_TOKEN_KINDS bool = false
-
 func main() {
+	// compile errors are reported without the stack of the compiler
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintln(os.Stderr, "penguin:", r)
+			os.Exit(1)
+		}
+	}()
 
-	dat := ReadSourceFile(os.Args[1])
-	tokens := TokenizeFile(dat)
+	os.Exit(Main(os.Args[1:]))
+}
+
+// Compile builds the entry of proj and the modules it imports into the files named by fileData,
+// stopping early as opts ask. Returns the path of the last artifact written
+func Compile(fileData files.FileData, proj project.Project, opts Options) string {
+	builtins := generator.NewRegistry()
+	ASTRoot, vars, funcs := ParseProgram(proj, opts, builtins)
+
+	// libraries are left as objects for a C program to link against
+	linked := !opts.AsmOnly && !opts.ObjOnly && !generator.IsLibrary(&funcs)
 
-	vars, funcs := InitMaps()
+	// intermediate files are built in a temporary directory, removed with them, unless kept next to the artifact
+	if !opts.AsmOnly && !opts.KeepTemps {
+		dir, err := os.MkdirTemp("", "penguin-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
 
-	ASTRoot := ParseTokens(tokens, &vars, &funcs)
+		fileData = files.TempFilepaths(fileData, dir, linked)
+	}
 
-	printVarMap(&vars)
+	if err := os.MkdirAll(fileData.BaseFilepath, 0755); err != nil {
+		panic(err)
+	}
 
-	fileData := files.GenerateFilepaths(os.Args)
 	asmFile := files.OpenTargetFile(fileData.AsmFilepath)
+	defer asmFile.Close()
 
-	GenerateAssembly(ASTRoot, &vars, &funcs, asmFile, fileData.AsmFilepath)
+	GenerateAssembly(ASTRoot, &vars, &funcs, builtins, generator.Options{NoBoundsChecks: opts.NoBoundsChecks}, asmFile, fileData.AsmFilepath)
+	emit(opts, proj, "asm", func(out io.Writer) { copyFile(out, fileData.AsmFilepath) })
+
+	if generator.HasExports(&funcs) {
+		GenerateHeader(&funcs, fileData)
+	}
+
+	if opts.AsmOnly {
+		return fileData.AsmFilepath
+	}
 
 	Assemble(fileData)
-	Link(fileData)
 
-	return
+	if !linked {
+		return fileData.ObjFilepath
+	}
+
+	Link(fileData, generator.NeedsLibc(&funcs), proj)
+
+	return fileData.ExecFilepath
+}
+
+// ParseProgram runs the front end over the entry of proj, the modules it imports and the standard library
+func ParseProgram(proj project.Project, opts Options, builtins *generator.Registry) (*parser.ASTNode, semantics.VarMap, semantics.FuncMap) {
+	dat := ReadSourceFile(proj.Entry)
+	tokens := TokenizeFile(dat)
+	emit(opts, proj, "tokens", func(out io.Writer) { printTokens(out, tokens, opts.TokenKinds) })
+
+	vars, funcs := InitMaps(builtins)
+
+	// the standard library is parsed first so the program can call into it
+	prelude := std.Load(&vars, &funcs)
+
+	ASTRoot := ParseTokens(tokens, proj, &vars, &funcs)
+	emit(opts, proj, "ast", func(out io.Writer) { printAST(out, ASTRoot) })
+
+	ASTRoot.Children = append(prelude.Children, ASTRoot.Children...)
+	emit(opts, proj, "ir", func(out io.Writer) { printIR(out, *ASTRoot, 0) })
+	emit(opts, proj, "symbols", func(out io.Writer) { printSymbols(out, &vars, &funcs) })
+
+	return ASTRoot, vars, funcs
 }
 
 func ReadSourceFile(filepath string) []byte {
@@ -50,46 +110,51 @@ func ReadSourceFile(filepath string) []byte {
 		panic(err)
 	}
 
-	fmt.Println("INPUT:")
-	fmt.Println(string(dat))
-
 	return dat
 }
 
 func TokenizeFile(srcData []byte) tokenizer.TokenStack {
-	tokens := tokenizer.Tokenize(srcData)
-	printTokens(tokens, PRINT_TOKEN_KINDS)
-
-	return tokens
+	return tokenizer.Tokenize(srcData)
 }
 
-func InitMaps() (semantics.VarMap, semantics.FuncMap) {
+func InitMaps(builtins *generator.Registry) (semantics.VarMap, semantics.FuncMap) {
 	vars := make(semantics.VarMap)
 
 	funcs := make(semantics.FuncMap)
-	funcs["exit"] = &semantics.Function{Mutable: false, Type: semantics.Int, NumArgs: 1}
-	funcs["print"] = &semantics.Function{Mutable: false, Type: semantics.Char, NumArgs: 1}
+	if err := generator.DeclareBuiltins(builtins, &funcs); err != nil {
+		panic(err)
+	}
 
 	return vars, funcs
 }
 
-func ParseTokens(tokens tokenizer.TokenStack, vars *semantics.VarMap, funcs *semantics.FuncMap) *parser.ASTNode {
-	ASTRoot := parser.Parse(&tokens, vars, funcs)
-	ASTRoot.Data = os.Args[1]
-	printAST(ASTRoot)
+func ParseTokens(tokens tokenizer.TokenStack, proj project.Project, vars *semantics.VarMap, funcs *semantics.FuncMap) *parser.ASTNode {
+	// imported modules are read from the source directories, by default the directory of the program
+	ASTRoot := module.Load(proj.Entry, proj.Sources, tokens, vars, funcs)
+	ASTRoot.Data = proj.Entry
 
 	return ASTRoot
 }
 
-func GenerateAssembly(root *parser.ASTNode, vars *semantics.VarMap, funcs *semantics.FuncMap, file *os.File, filepath string) {
-	generator.Generate(root, vars, funcs, file)
+func GenerateAssembly(root *parser.ASTNode, vars *semantics.VarMap, funcs *semantics.FuncMap, builtins *generator.Registry, genOpts generator.Options, file *os.File, filepath string) {
+	generator.Generate(root, vars, funcs, builtins, genOpts, file)
 	log.Println("Completed generating assembly to " + filepath)
 
 }
 
+func GenerateHeader(funcs *semantics.FuncMap, fileData files.FileData) {
+	hdrFile := files.OpenTargetFile(fileData.HdrFilepath)
+	defer hdrFile.Close()
+
+	if err := generator.GenerateHeader(fileData.BaseFilename, funcs, hdrFile); err != nil {
+		panic(err)
+	}
+
+	log.Println("Completed generating header to " + fileData.HdrFilepath)
+}
+
 func Assemble(fileData files.FileData) {
-	assembleCmd := exec.Command("nasm", "-felf64", fileData.AsmFilename)
-	assembleCmd.Dir = fileData.BaseFilepath
+	assembleCmd := exec.Command("nasm", "-felf64", fileData.AsmFilepath, "-o", fileData.ObjFilepath)
 	if err := assembleCmd.Run(); err != nil {
 		log.Println("Assembly Failed")
 		panic(err)
@@ -98,84 +163,38 @@ func Assemble(fileData files.FileData) {
 	log.Println("Completed assembling to " + fileData.ObjFilepath)
 }
 
-func Link(fileData files.FileData) {
-	linkCmd := exec.Command("ld", fileData.ObjFilename, "-o", fileData.BaseFilename)
-	linkCmd.Dir = fileData.BaseFilepath
-	if err := linkCmd.Run(); err != nil {
-		log.Print("Linking Failed")
+func Link(fileData files.FileData, libc bool, proj project.Project) {
+	// link flags are given relative to the project file, so the link runs there on absolute paths
+	obj, err := filepath.Abs(fileData.ObjFilepath)
+	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Completed linking to " + fileData.ExecFilepath)
-}
+	executable, err := filepath.Abs(fileData.ExecFilepath)
+	if err != nil {
+		panic(err)
+	}
 
-func printTokens(tokens tokenizer.TokenStack, printKinds bool) {
-	fmt.Println("TOKENS:")
-	for _, token := range tokens.Tokens {
-		if token.Data == "\n" {
-			fmt.Print("\\n\\", "\n")
-		} else {
-			var kind string
-			if printKinds {
-				kind = token.Kind.String() + ":"
-			} else {
-				kind = ""
-			}
-			fmt.Print(kind+token.Data, "\t")
+	args := append([]string{obj, "-o", executable}, proj.LinkFlags...)
+	linkCmd := exec.Command("ld", args...)
+	if libc || len(proj.Libs) > 0 {
+		for _, lib := range proj.Libs {
+			args = append(args, "-l"+lib)
 		}
-	}
-}
 
-func printAST(ASTRoot *parser.ASTNode) {
-	t := tree.NewTree(tree.NodeString(formatASTNode(*ASTRoot)))
-	for _, l1Node := range ASTRoot.Children {
-		l1TreeNode := t.AddChild(tree.NodeString(formatASTNode(l1Node)))
-		for _, l2Node := range l1Node.Children {
-			l2TreeNode := l1TreeNode.AddChild(tree.NodeString(formatASTNode(l2Node)))
-			for _, l3Node := range l2Node.Children {
-				l3TreeNode := l2TreeNode.AddChild(tree.NodeString(formatASTNode(l3Node)))
-				for _, l4Node := range l3Node.Children {
-					l4TreeNode := l3TreeNode.AddChild(tree.NodeString(formatASTNode(l4Node)))
-					for _, l5Node := range l4Node.Children {
-						l4TreeNode.AddChild(tree.NodeString(formatASTNode(l5Node)))
-					}
-				}
-			}
+		// the C compiler driver adds the C runtime and libc, generated code is not position independent
+		flags := []string{"-no-pie"}
+		if !libc {
+			// programs that call no C functions bring their own entry point
+			flags = append(flags, "-nostartfiles")
 		}
+		linkCmd = exec.Command("cc", append(flags, args...)...)
 	}
-	fmt.Println(t)
-}
-
-func formatASTNode(node parser.ASTNode) string {
-	switch node.Kind {
-	case parser.Program:
-		return node.Kind.String() + ": " + node.Data
-	case parser.Declaration:
-		return node.Kind.String() + ": " + node.Data + "\n" + "Mutable: " + strconv.FormatBool(node.Mutable) + "\n" + "Type: " + node.Type.String()
-	case parser.Scope:
-		return node.Kind.String() + ": " + "'" + node.Parent.Data + "'"
-	case parser.Statement:
-		return node.Kind.String() + ": " + node.Data
-	case parser.Expression:
-		return node.Kind.String() + ": " + node.Data + "\n" + "Prec: " + strconv.Itoa(node.Precedence)
-	case parser.Identifier:
-		return node.Kind.String() + ": " + node.Data + "\n" + "Type: " + node.Type.String() + "\n" + "Prec: " + strconv.Itoa(node.Precedence)
-	case parser.Term:
-		return node.Kind.String() + ": " + node.Data + "\n" + "Type: " + node.Type.String() + "\n" + "Prec: " + strconv.Itoa(node.Precedence)
-	default:
-		return node.Kind.String() + ": " + node.Data + "\n" + "Type: " + node.Type.String() + "\n"
+	linkCmd.Dir = proj.Dir
+	if err := linkCmd.Run(); err != nil {
+		log.Print("Linking Failed")
+		panic(err)
 	}
-}
 
-func printVarMap(vars *semantics.VarMap) {
-	fmt.Println("VARIABLE MAP: ")
-	for k, v := range *vars {
-		variable := *v
-		fmt.Print(k + ": ")
-		fmt.Printf("%v ", variable.Mutable)
-		fmt.Printf("%v ", variable.Type.String())
-		fmt.Printf("%v ", variable.StackLocation)
-		fmt.Print("\t")
-	}
-	fmt.Print("\n\n")
+	log.Println("Completed linking to " + fileData.ExecFilepath)
 }
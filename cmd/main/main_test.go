@@ -3,28 +3,41 @@ package main_test
 import (
 	"flag"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 var expected = flag.String("expect", "0", "Expected exit code for compiled executable")
 
+// requireNasm skips tests that assemble programs where nasm is not installed
+func requireNasm(t *testing.T) {
+	if _, err := exec.LookPath("nasm"); err != nil {
+		t.Skip("nasm not found, not building the program")
+	}
+}
+
 func TestCompile(t *testing.T) {
+	requireNasm(t)
 
-	defer ExecuteProgram(t)
-	CompileProgram(t)
+	// the program is built outside test/ so running the tests leaves the tree clean
+	dir := t.TempDir()
+	defer ExecuteProgram(t, dir)
+	CompileProgram(t, dir)
 }
 
-func CompileProgram(t *testing.T) {
-	runCompile := exec.Command("go", "run", ".", "../../test/testfile.pn")
+func CompileProgram(t *testing.T, dir string) {
+	runCompile := exec.Command("go", "run", ".", "build", "--keep-temps", "--out-dir", dir, "../../test/testfile.pn")
 	if err := runCompile.Run(); err != nil {
 		t.Errorf("Compilation did not complete, error: %v", err)
 	}
 }
 
-func ExecuteProgram(t *testing.T) {
+func ExecuteProgram(t *testing.T, dir string) {
 	runExec := exec.Command("./testfile")
-	runExec.Dir = "../../test"
+	runExec.Dir = dir
 	out, err := runExec.Output()
 	if err != nil {
 		t.Errorf("Program exited with %v, expected %v", err, *expected)
@@ -33,3 +46,101 @@ func ExecuteProgram(t *testing.T) {
 	}
 
 }
+
+func TestUsage(t *testing.T) {
+	runUsage := exec.Command("go", "run", ".")
+	out, err := runUsage.CombinedOutput()
+
+	if !strings.Contains(string(out), "usage: penguin <command>") || strings.Contains(string(out), "panic") {
+		t.Errorf("Expected usage without arguments, got:\n%v", string(out))
+	}
+	if err == nil {
+		t.Errorf("Expected a failing exit status without arguments")
+	}
+}
+
+func TestMissingSource(t *testing.T) {
+	runCheck := exec.Command("go", "run", ".", "check", "../../test/missing.pn")
+	out, err := runCheck.CombinedOutput()
+
+	if !strings.Contains(string(out), "stat ../../test/missing.pn: no such file or directory") {
+		t.Errorf("Expected the missing file to be reported, got:\n%v", string(out))
+	}
+	if err == nil {
+		t.Errorf("Expected a failing exit status for a missing file")
+	}
+}
+
+func TestEmit(t *testing.T) {
+	runCheck := exec.Command("go", "run", ".", "check", "--emit=symbols", "../../test/testfile.pn")
+	out, err := runCheck.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Check did not complete, error: %v\n%v", err, string(out))
+	}
+
+	if !strings.HasPrefix(string(out), "SYMBOLS:\nglobals:\n") || !strings.Contains(string(out), "  main() Int _main") {
+		t.Errorf("Expected only the symbols of the program, got:\n%v", string(out))
+	}
+}
+
+func TestEmitDir(t *testing.T) {
+	// a missing emit directory is created like an output directory
+	dir := filepath.Join(t.TempDir(), "emitted")
+	runCheck := exec.Command("go", "run", ".", "check", "--emit=symbols", "--emit-dir", dir, "../../test/testfile.pn")
+	if out, err := runCheck.CombinedOutput(); err != nil {
+		t.Fatalf("Check did not complete, error: %v\n%v", err, string(out))
+	}
+
+	dat, err := os.ReadFile(filepath.Join(dir, "testfile.symbols"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(dat), "globals:\n") {
+		t.Errorf("Expected the symbols of the program, got:\n%v", string(dat))
+	}
+}
+
+func TestOutDir(t *testing.T) {
+	requireNasm(t)
+
+	dir := t.TempDir()
+	runCompile := exec.Command("go", "run", ".", "build", "--out-dir", dir, "../../test/testfile.pn")
+	if out, err := runCompile.CombinedOutput(); err != nil {
+		t.Fatalf("Compilation did not complete, error: %v\n%v", err, string(out))
+	}
+
+	// the assembly and object are built in a temporary directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "testfile" {
+		t.Errorf("Expected only the executable in the output directory, got %v", entries)
+	}
+}
+
+func TestLinkFlags(t *testing.T) {
+	requireNasm(t)
+
+	dir := t.TempDir()
+	project := `{"entry": "main.pn", "out_dir": "build", "link_flags": ["-Map=app.map"]}`
+	if err := os.WriteFile(filepath.Join(dir, "penguin.json"), []byte(project), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.pn"), []byte("int main() {\n    return 0\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runCompile := exec.Command("go", "run", ".", "build", dir)
+	if out, err := runCompile.CombinedOutput(); err != nil {
+		t.Fatalf("Compilation did not complete, error: %v\n%v", err, string(out))
+	}
+
+	// paths in link flags are relative to the project file, not to the executable
+	if _, err := os.Stat(filepath.Join(dir, "app.map")); err != nil {
+		t.Errorf("Expected the link map next to the project file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "build", "main")); err != nil {
+		t.Errorf("Expected the executable in the output directory: %v", err)
+	}
+}
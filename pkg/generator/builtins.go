@@ -0,0 +1,271 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GenM4/penguin/pkg/parser"
+	"github.com/GenM4/penguin/pkg/semantics"
+)
+
+// BuiltinGen expands a call to a builtin inline, leaving its result in to
+type BuiltinGen func(to Register, node parser.ASTNode, genData *GeneratorData) error
+
+// Builtin is a function provided by the compiler instead of being defined in penguin.
+// Builtins without a Gen hook are called like penguin functions through their Label
+type Builtin struct {
+	Signature string // parameter types such as "min(int, int)", ending in "..." when variadic
+	Returns   string // return type such as "*mut byte"
+	MaxArgs   int    // total arguments accepted by variadic builtins
+	Label     string
+	Fold      func(args []int) (int, error) // evaluates calls with constant arguments, nil for builtins with side effects
+	Gen       BuiltinGen
+	Prelude   bool // declared in the standard library, so programs and externs can take the name like any std function
+}
+
+// key returns the name funcs holds the builtin under
+func (builtin Builtin) key(name string) string {
+	if builtin.Prelude {
+		return parser.Prelude + "." + name
+	}
+
+	return name
+}
+
+// Registry holds the builtins of one compilation, so builtins registered for one program do not leak into the next
+type Registry struct {
+	builtins map[string]Builtin
+}
+
+// the standard builtins every registry starts with
+var defaultBuiltins = map[string]Builtin{
+	"exit":    {Signature: "exit(int)", Returns: "int", Gen: genExit},
+	"print":   {Signature: "print(char)", Returns: "void", Gen: genPrint},
+	"alloc":   {Signature: "alloc(int)", Returns: "*mut byte", Label: AllocLabel},
+	"free":    {Signature: "free(*mut byte)", Returns: "void", Label: FreeLabel},
+	"abs":     {Signature: "abs(int)", Returns: "int", Fold: foldAbs, Gen: genAbs, Prelude: true},
+	"min":     {Signature: "min(int, int)", Returns: "int", Fold: foldMin, Gen: genMinMax, Prelude: true},
+	"max":     {Signature: "max(int, int)", Returns: "int", Fold: foldMax, Gen: genMinMax, Prelude: true},
+	"syscall": {Signature: "syscall(int, ...)", Returns: "int", MaxArgs: len(syscallRegisters), Gen: genSyscall},
+}
+
+// syscallRegisters hold the number and arguments of a Linux system call
+var syscallRegisters = []Register{RAX, RDI, RSI, RDX, R10, R8, R9}
+
+// NewRegistry returns a registry holding the standard builtins
+func NewRegistry() *Registry {
+	registry := &Registry{builtins: make(map[string]Builtin)}
+	for name, builtin := range defaultBuiltins {
+		registry.builtins[builtin.key(name)] = builtin
+	}
+
+	return registry
+}
+
+// Register adds a builtin to the programs compiled with this registry
+func (registry *Registry) Register(builtin Builtin) error {
+	open := strings.Index(builtin.Signature, "(")
+	if open <= 0 {
+		return fmt.Errorf("Malformed signature %v", builtin.Signature)
+	}
+
+	name := builtin.Signature[:open]
+	if _, ok := registry.builtins[builtin.key(name)]; ok {
+		return fmt.Errorf("Builtin '%v' already registered", name)
+	}
+
+	if builtin.Gen == nil && builtin.Label == "" {
+		return fmt.Errorf("Builtin '%v' needs a codegen hook or a label to call", name)
+	}
+
+	registry.builtins[builtin.key(name)] = builtin
+
+	return nil
+}
+
+// DeclareBuiltins starts a compilation by adding every builtin of registry to funcs.
+// The struct and pointer types of the previous compilation are dropped first, as builtin signatures declare pointer types
+func DeclareBuiltins(registry *Registry, funcs *semantics.FuncMap) error {
+	semantics.ResetTypes()
+
+	for key, builtin := range registry.builtins {
+		params, err := semantics.ParseSignature(builtin.Signature)
+		if err != nil {
+			return err
+		}
+
+		typ, err := semantics.ParseTypeName(builtin.Returns)
+		if err != nil {
+			return fmt.Errorf("%v in return type of builtin '%v'", err, key)
+		}
+
+		(*funcs)[key] = &semantics.Function{Type: typ, Signature: builtin.Label, Params: params, Variadic: strings.HasSuffix(builtin.Signature, "...)"), MaxArgs: builtin.MaxArgs, Fold: builtin.Fold, Builtin: true, Public: builtin.Prelude}
+	}
+
+	return nil
+}
+
+// GenArg evaluates an argument of a builtin call into to
+func (genData *GeneratorData) GenArg(to Register, node parser.ASTNode) error {
+	return genAtom(to, node, genData)
+}
+
+// Emit writes one line of assembly, indenting it unless it is a label
+func (genData *GeneratorData) Emit(line string) error {
+	return emitLine(line, genData)
+}
+
+// Push and Pop keep track of the stack alignment for calls made by builtins
+func (genData *GeneratorData) Push(reg Register) error {
+	return push(reg, genData)
+}
+
+func (genData *GeneratorData) Pop(reg Register) error {
+	return pop(reg, genData)
+}
+
+func genExit(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	err := genAtom(RDI, node.Children[0], genData)
+	if err != nil {
+		return err
+	}
+
+	// exiting through libc flushes its buffered streams, exit does not return so rsp can be realigned
+	if genData.libc {
+		_, err = genData.asmFile.WriteString("\tand rsp, -16\n\tcall exit\n")
+		return err
+	}
+
+	err = move(RAX, OpCode(60), genData)
+	if err != nil {
+		return err
+	}
+
+	_, err = genData.asmFile.WriteString("\tsyscall\n")
+
+	return err
+}
+
+func genPrint(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	if node.Children[0].Type != semantics.Char {
+		return fmt.Errorf("print only implemented for char, attempted call with type %v", node.Type.String())
+	}
+
+	genAtom(RAX, node.Children[0], genData)
+	push(RAX, genData)
+
+	move(RAX, OpCode(1), genData)
+	move(RDI, OpCode(1), genData)
+	move(RSI, RSP, genData)
+	move(RDX, OpCode(1), genData)
+	genData.asmFile.WriteString("\tsyscall\n")
+
+	return pop(RAX, genData)
+}
+
+func genAbs(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	err := genAtom(RAX, node.Children[0], genData)
+	if err != nil {
+		return err
+	}
+
+	move(RDX, RAX, genData)
+	genData.asmFile.WriteString("\tneg rax\n\tcmovl rax, rdx\n")
+
+	if to != RAX {
+		return move(to, RAX, genData)
+	}
+
+	return nil
+}
+
+func genMinMax(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	err := genAtom(RAX, node.Children[0], genData)
+	if err != nil {
+		return err
+	}
+
+	push(RAX, genData)
+
+	err = genAtom(RAX, node.Children[1], genData)
+	if err != nil {
+		return err
+	}
+
+	move(RDX, RAX, genData)
+	pop(RAX, genData)
+
+	cmov := "cmovg"
+	if node.Data == parser.Prelude+".max" {
+		cmov = "cmovl"
+	}
+	genData.asmFile.WriteString("\tcmp rax, rdx\n\t" + cmov + " rax, rdx\n")
+
+	if to != RAX {
+		return move(to, RAX, genData)
+	}
+
+	return nil
+}
+
+func genSyscall(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	// the number and arguments are evaluated onto the stack so nested calls cannot clobber them
+	for _, arg := range node.Children {
+		err := genAtom(RAX, arg, genData)
+		if err != nil {
+			return err
+		}
+
+		err = push(RAX, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(node.Children) - 1; i >= 0; i-- {
+		err := pop(syscallRegisters[i], genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := genData.asmFile.WriteString("\tsyscall\n")
+	if err != nil {
+		return err
+	}
+
+	if to != RAX {
+		return move(to, RAX, genData)
+	}
+
+	return nil
+}
+
+func foldAbs(args []int) (int, error) {
+	if args[0] >= 0 {
+		return args[0], nil
+	}
+
+	// the negation of the smallest int does not fit
+	if -args[0] < 0 {
+		return 0, fmt.Errorf("Constant expression abs(%v) overflows %v", args[0], semantics.Int.String())
+	}
+
+	return -args[0], nil
+}
+
+func foldMin(args []int) (int, error) {
+	if args[1] < args[0] {
+		return args[1], nil
+	}
+
+	return args[0], nil
+}
+
+func foldMax(args []int) (int, error) {
+	if args[1] > args[0] {
+		return args[1], nil
+	}
+
+	return args[0], nil
+}
@@ -3,9 +3,14 @@ package generator
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/GenM4/penguin/pkg/parser"
 	"github.com/GenM4/penguin/pkg/semantics"
@@ -20,7 +25,7 @@ func (oc OpCode) String() string {
 type IntLiteral int
 
 func (i IntLiteral) String() string {
-	return strconv.Itoa(int(i)) + "h"
+	return strconv.Itoa(int(i))
 }
 
 type CharLiteral string
@@ -48,6 +53,21 @@ const (
 	ESI
 	RSP
 	RBP
+	AL
+	BL
+	CL
+	DL
+	DIL
+	SIL
+	R8
+	R9
+	R8B
+	R9B
+	R10
+	R12
+	R13
+	R14
+	R15
 )
 
 func (reg Register) String() string {
@@ -64,25 +84,107 @@ func (reg Register) String() string {
 		"esi",
 		"rsp",
 		"rbp",
+		"al",
+		"bl",
+		"cl",
+		"dl",
+		"dil",
+		"sil",
+		"r8",
+		"r9",
+		"r8b",
+		"r9b",
+		"r10",
+		"r12",
+		"r13",
+		"r14",
+		"r15",
 	}
 
 	i := int(reg)
 	switch {
-	case i <= int(RBP):
+	case i <= int(R15):
 		return name[i]
 	default:
 		return strconv.Itoa(i)
 	}
 }
 
+func (reg Register) Low() Register {
+	// returns the register addressing the lowest byte of reg
+	switch reg {
+	case RAX:
+		return AL
+	case RBX:
+		return BL
+	case RCX:
+		return CL
+	case RDX:
+		return DL
+	case RDI:
+		return DIL
+	case RSI:
+		return SIL
+	case R8:
+		return R8B
+	case R9:
+		return R9B
+	default:
+		return reg
+	}
+}
+
+// calleeSaved are the registers the System V ABI requires a function to preserve, besides rbp and rsp
+var calleeSaved = []Register{RBX, R12, R13, R14, R15}
+
+// registerViews names every part of a register that inline assembly can write
+var registerViews = map[Register][]string{
+	RBX: {"rbx", "ebx", "bx", "bl", "bh"},
+	R12: {"r12", "r12d", "r12w", "r12b"},
+	R13: {"r13", "r13d", "r13w", "r13b"},
+	R14: {"r14", "r14d", "r14w", "r14b"},
+	R15: {"r15", "r15d", "r15w", "r15b"},
+}
+
+// clobber records a write to reg so the current function saves it if it is callee-saved
+func clobber(reg Register, genData *GeneratorData) {
+	if reg == BL {
+		reg = RBX
+	}
+
+	if genData.clobbered != nil {
+		genData.clobbered[reg] = true
+	}
+}
+
 type StackAddress struct {
 	Register Register
-	Offset   int
+	Label    string // addressed relative to rip instead of Register when set
+	Offset   int    // in bytes
 	Size     string
+	Index    Register
+	Scale    int // element size in bytes, 0 when not indexed
 }
 
 func (sa StackAddress) String() string {
-	return sa.Size + " [" + sa.Register.String() + " + " + strconv.Itoa(8*sa.Offset) + "]"
+	addr := sa.Register.String()
+	if sa.Label != "" {
+		addr = "rel " + sa.Label
+	} else if sa.Scale != 0 {
+		addr += " + " + sa.Index.String() + "*" + strconv.Itoa(sa.Scale)
+	}
+
+	if sa.Offset < 0 {
+		addr += " - " + strconv.Itoa(-sa.Offset)
+	} else if sa.Offset > 0 {
+		addr += " + " + strconv.Itoa(sa.Offset)
+	}
+
+	if sa.Size == "" {
+		return "[" + addr + "]"
+	}
+
+	return sa.Size + " [" + addr + "]"
 }
 
 type movable interface {
@@ -100,77 +202,235 @@ type popable interface {
 	String() string
 }
 
+const boundsErrorLabel = "__bounds_error"
+
+// initLabel runs the initializers of globals that are not known at compile time before main
+const initLabel = "__init_globals"
+
+type global struct {
+	name   string
+	values []string // initial value of each element, nil for globals in .bss
+}
+
 type GeneratorData struct {
-	asmFile          *os.File
+	asmFile          io.StringWriter
 	argRegisters     []Register
 	stackPtrLocation int
+	frameSize        int
+	returnSlot       int
+	labelCount       int
+	function         string
+	boundsChecks     bool // checks indices not known at compile time against the array length
+	boundsChecked    bool
+	heapUsed         bool
+	clobbered        map[Register]bool // callee-saved registers written by the current function
+	libc             bool
+	library          bool
+	hasInit          bool
+	globals          []global
 	vars             *semantics.VarMap
 	funcs            *semantics.FuncMap
+	builtins         *Registry
+}
+
+const (
+	// Matches with at least this many cases, covering at least half of the
+	// values between the smallest and largest case, compile to a jump table
+	jumpTableMinCases = 4
+	jumpTableMaxSpan  = 512
+)
+
+type matchCase struct {
+	lo    int
+	hi    int
+	label string
+}
+
+// Options change the code generated for one compilation, their zero value being the default
+type Options struct {
+	NoBoundsChecks bool // leaves out the runtime checks on array indices
 }
 
-func Generate(root *parser.ASTNode, vars *semantics.VarMap, funcs *semantics.FuncMap, out *os.File) {
+func Generate(root *parser.ASTNode, vars *semantics.VarMap, funcs *semantics.FuncMap, builtins *Registry, opts Options, out *os.File) {
 	genData := GeneratorData{
 		asmFile:          out,
-		argRegisters:     []Register{RDI, RSI, RDX, RCX},
+		argRegisters:     []Register{RDI, RSI, RDX, RCX, R8, R9},
 		stackPtrLocation: 1,
+		boundsChecks:     !opts.NoBoundsChecks,
 		vars:             vars,
 		funcs:            funcs,
+		builtins:         builtins,
+		libc:             NeedsLibc(funcs),
+		library:          IsLibrary(funcs),
+	}
+
+	entry := "_start"
+	if genData.libc {
+		entry = "main"
+	}
+
+	// libraries are linked into a C program that provides the entry point
+	if !genData.library {
+		_, err := genData.asmFile.WriteString("global " + entry + "\n")
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	_, err := genData.asmFile.WriteString("global _start\n")
+	err := genExports(&genData)
+	if err != nil {
+		panic(err)
+	}
 
+	err = genExterns(&genData)
 	if err != nil {
 		panic(err)
 	}
 
 	err = genProgram(*root, &genData)
 	if err != nil {
-		genData.asmFile.Close()
+		out.Close()
+		panic(err)
+	}
+
+	err = genStart(&genData)
+	if err != nil {
 		panic(err)
 	}
 
-	err = genDefaultExit(genData.asmFile, &genData)
+	if genData.boundsChecked {
+		err = genBoundsError(&genData)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if genData.heapUsed {
+		err = genHeapRuntime(&genData)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = genGlobals(&genData)
 	if err != nil {
 		panic(err)
 	}
 
+	// the C toolchain otherwise assumes objects without this note need an executable stack
+	if genData.libc || genData.library {
+		_, err = genData.asmFile.WriteString("section .note.GNU-stack noalloc noexec nowrite progbits\n")
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	return
 }
 
 func genProgram(node parser.ASTNode, genData *GeneratorData) error {
+	used := usedFunctions(node, genData)
+
+	// statements in global scope are collected into a function run before main
+	var inits []parser.ASTNode
 	for _, child := range node.Children {
 		if child.Kind == parser.Statement || child.Kind == parser.Call {
-			log.Println("Generating assembly for statement: " + child.Data + " in global scope")
-			err := genStatement(child, genData)
-			if err != nil {
-				return err
+			if child.Data == "=" && child.Children[0].Kind == parser.Declaration {
+				values, static := staticValues(child.Children[0], child.Children[1], genData)
+				genData.globals = append(genData.globals, global{name: child.Children[0].Data, values: values})
+
+				if static {
+					continue
+				}
 			}
+
+			inits = append(inits, child)
+		} else if child.Kind == parser.Struct || child.Kind == parser.Extern {
+			continue
 		} else if child.Kind == parser.Declaration {
-			if len(child.Children) > 0 {
+			if len(child.Children) > 0 && isLibrary(child, genData) && !used[child.Data] {
+				continue
+			} else if len(child.Children) > 0 {
 				log.Println("Generating assembly for declaration: " + child.Data + "() in global scope")
 				err := genDeclaration(child, genData)
 				if err != nil {
 					return err
 				}
 			} else {
-				continue
+				genData.globals = append(genData.globals, global{name: child.Data})
 			}
 		} else {
 			return fmt.Errorf("Unexpected %v in %v", child.Kind.String(), node.Kind.String())
 		}
 	}
-	return nil
+
+	if len(inits) == 0 {
+		return nil
+	}
+
+	log.Println("Generating assembly for statements in global scope")
+	genData.hasInit = true
+
+	scope := parser.ASTNode{Kind: parser.Scope, Parent: &node, Children: inits}
+
+	return genFunction(initLabel, "", nil, scope, genData)
 }
 
-func genDeclaration(node parser.ASTNode, genData *GeneratorData) error {
-	if node.Data == "main" {
-		genData.asmFile.WriteString("_start:\n")
-	} else {
-		genData.asmFile.WriteString((*genData.funcs)[node.Data].Signature + ":" + "\n")
+// usedFunctions finds the functions called from the program, following calls made by library functions
+func usedFunctions(root parser.ASTNode, genData *GeneratorData) map[string]bool {
+	used := make(map[string]bool)
+	bodies := make(map[string]parser.ASTNode)
+	for _, child := range root.Children {
+		if child.Kind == parser.Declaration && len(child.Children) > 0 && isLibrary(child, genData) {
+			bodies[child.Data] = child
+			continue
+		}
+
+		collectCalls(child, used)
+	}
+
+	for done := false; !done; {
+		done = true
+		for name := range used {
+			if body, ok := bodies[name]; ok {
+				delete(bodies, name)
+				collectCalls(body, used)
+				done = false
+			}
+		}
+	}
+
+	return used
+}
+
+func isLibrary(decl parser.ASTNode, genData *GeneratorData) bool {
+	function, ok := (*genData.funcs)[decl.Data]
+	return ok && function.Library
+}
+
+func collectCalls(node parser.ASTNode, calls map[string]bool) {
+	if node.Kind == parser.Call {
+		calls[node.Data] = true
+	}
+
+	for _, child := range node.Children {
+		collectCalls(child, calls)
 	}
+}
+
+func genDeclaration(node parser.ASTNode, genData *GeneratorData) error {
+	signature := (*genData.funcs)[node.Data].Signature
+
+	return genFunction(signature, node.Data, node.Children[:len(node.Children)-1], node.Children[len(node.Children)-1], genData)
+}
+
+func genFunction(signature string, name string, args []parser.ASTNode, scope parser.ASTNode, genData *GeneratorData) error {
+	genData.asmFile.WriteString(signature + ":" + "\n")
 
 	localStackLocation := genData.stackPtrLocation
 	genData.stackPtrLocation = 1
+	genData.frameSize = 0
+	genData.function = name
 
 	err := push(RBP, genData)
 	if err != nil {
@@ -182,12 +442,73 @@ func genDeclaration(node parser.ASTNode, genData *GeneratorData) error {
 		return err
 	}
 
-	err = genArguments(node.Children[:len(node.Children)-1], genData)
+	// the body is generated first so the frame size and clobbered registers are known in the prologue
+	out := genData.asmFile
+	body := new(strings.Builder)
+	genData.asmFile = body
+	genData.clobbered = make(map[Register]bool)
+
+	err = genArguments(args, genData)
+	if err != nil {
+		return err
+	}
+
+	err = genScope(scope, genData)
+	if err != nil {
+		return err
+	}
+
+	// falling off the end of main exits with status 0
+	if name == "main" {
+		err = move(RAX, IntLiteral(0), genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	genData.asmFile = out
+
+	// callee-saved registers used by the body are kept in the frame across the call
+	var saved []Register
+	var slots []StackAddress
+	for _, reg := range calleeSaved {
+		if genData.clobbered[reg] {
+			saved = append(saved, reg)
+			slots = append(slots, StackAddress{Register: RBP, Offset: allocate(8, genData), Size: "QWORD"})
+		}
+	}
+
+	// keep rsp 16 byte aligned
+	err = arithmetic("sub", RSP, (genData.frameSize+15)/16*16, genData)
+	if err != nil {
+		return err
+	}
+
+	for i, reg := range saved {
+		err = store(slots[i], reg, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = genData.asmFile.WriteString(body.String())
+	if err != nil {
+		return err
+	}
+
+	err = label(".return", genData)
 	if err != nil {
 		return err
 	}
 
-	err = genScope(node.Children[len(node.Children)-1], genData)
+	for i, reg := range saved {
+		err = load(reg, slots[i], genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = move(RSP, RBP, genData)
 	if err != nil {
 		return err
 	}
@@ -198,18 +519,86 @@ func genDeclaration(node parser.ASTNode, genData *GeneratorData) error {
 	}
 
 	genData.asmFile.WriteString("\tret\n")
+
 	genData.stackPtrLocation = localStackLocation
+	genData.function = ""
 
 	return nil
 }
 
 func genArguments(args []parser.ASTNode, genData *GeneratorData) error {
-	if len(args) > len(genData.argRegisters) {
-		return fmt.Errorf("Exceeded maximum number of arguments in function call")
+	registers := genData.argRegisters
+
+	// functions returning a struct receive the address to copy it to before their arguments
+	if function, ok := (*genData.funcs)[genData.function]; ok && function.Type.IsStruct() {
+		genData.returnSlot = allocate(8, genData)
+
+		err := store(StackAddress{Register: RBP, Offset: genData.returnSlot, Size: "QWORD"}, RDI, genData)
+		if err != nil {
+			return err
+		}
+
+		registers = registers[1:]
 	}
 
+	// struct arguments are passed by address and copied once every register has been saved
+	var structArgs []parser.ASTNode
 	for i, arg := range args {
-		err := genArg(genData.argRegisters[i], arg, genData)
+		if i >= len(registers) {
+			break
+		}
+
+		variable := lookup(arg.Data, genData)
+		if !variable.Type.IsStruct() {
+			err := genArg(registers[i], arg, genData)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		variable.StackLocation = allocate(variable.Size(), genData)
+		structArgs = append(structArgs, arg)
+
+		err := push(registers[i], genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(structArgs) - 1; i >= 0; i-- {
+		err := pop(RAX, genData)
+		if err != nil {
+			return err
+		}
+
+		variable := lookup(structArgs[i].Data, genData)
+
+		err = copyStruct(variableAddress(structArgs[i].Data, variable), variable.Size(), genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the remaining arguments were pushed by the caller above the return address
+	for i := len(registers); i < len(args); i++ {
+		variable := lookup(args[i].Data, genData)
+		slot := StackAddress{Register: RBP, Offset: 16 + 8*(i-len(registers)), Size: "QWORD"}
+
+		if !variable.Type.IsStruct() {
+			variable.StackLocation = slot.Offset
+			continue
+		}
+
+		err := load(RAX, slot, genData)
+		if err != nil {
+			return err
+		}
+
+		variable.StackLocation = allocate(variable.Size(), genData)
+
+		err = copyStruct(variableAddress(args[i].Data, variable), variable.Size(), genData)
 		if err != nil {
 			return err
 		}
@@ -226,6 +615,8 @@ func genScope(node parser.ASTNode, genData *GeneratorData) error {
 			if err != nil {
 				return err
 			}
+		} else if child.Kind == parser.Declaration && len(child.Children) == 0 {
+			genLocal(child, genData)
 		} else {
 			return fmt.Errorf("Unexpected %v in %v: '%v'", child.Kind.String(), node.Kind.String(), node.Data)
 		}
@@ -238,27 +629,40 @@ func genScope(node parser.ASTNode, genData *GeneratorData) error {
 func genStatement(node parser.ASTNode, genData *GeneratorData) error {
 	if node.Data == "=" {
 		if node.Children[0].Kind == parser.Declaration {
-			if variable, ok := (*genData.vars)[node.Children[0].Data]; ok {
+			if variable := lookup(node.Children[0].Data, genData); variable != nil {
 				if node.Children[1].Type == semantics.Untyped {
 					node.Children[1].Type = node.Children[0].Type
 				}
 
+				if variable.IsArray() {
+					return genArrayLiteral(node.Children[0].Data, variable, node.Children[1], genData)
+				}
+
 				err := genAtom(RAX, node.Children[1], genData)
 				if err != nil {
 					return err
 				}
 
-				variable.StackLocation = genData.stackPtrLocation
+				if !variable.IsGlobal {
+					variable.StackLocation = allocate(variable.Size(), genData)
+				}
+
+				if variable.Type.IsStruct() {
+					return copyStruct(variableAddress(node.Children[0].Data, variable), variable.Size(), genData)
+				}
 
 				err = reassign(node.Children[0], genData)
 				if err != nil {
 					return err
 				}
-
-				genData.stackPtrLocation += 1
 			} else {
 				return fmt.Errorf("Variable: '%v' already declared", node.Children[0].Data)
 			}
+		} else if node.Children[0].Kind != parser.Identifier && node.Children[0].Mutable == true {
+			err := genAssignment(node.Children[0], node.Children[1], genData)
+			if err != nil {
+				return err
+			}
 		} else if node.Children[0].Kind == parser.Identifier && node.Children[0].Mutable == true {
 			if node.Children[1].Type == semantics.Untyped {
 				node.Children[1].Type = node.Children[0].Type
@@ -269,6 +673,11 @@ func genStatement(node parser.ASTNode, genData *GeneratorData) error {
 				return err
 			}
 
+			if node.Children[0].Type.IsStruct() {
+				variable := lookup(node.Children[0].Data, genData)
+				return copyStruct(variableAddress(node.Children[0].Data, variable), variable.Size(), genData)
+			}
+
 			err = reassign(node.Children[0], genData)
 			if err != nil {
 				return err
@@ -298,120 +707,459 @@ func genStatement(node parser.ASTNode, genData *GeneratorData) error {
 		if err != nil {
 			return err
 		}
+	} else if node.Data == "match" {
+		err := genMatch(node, genData)
+		if err != nil {
+			return err
+		}
+	} else if node.Data == "asm" {
+		err := genAsm(node.Children[0], genData)
+		if err != nil {
+			return err
+		}
 	} else if node.Data == "return" {
+		if genData.function == "" {
+			return fmt.Errorf("Return statement outside of a function")
+		}
+
+		if len(node.Children) == 0 {
+			return jump("jmp", ".return", genData)
+		}
+
 		expr := node.Children[0]
 
 		err := genAtom(RAX, expr, genData)
 		if err != nil {
 			return err
 		}
-	}
-	return nil
-}
-
-func genAtom(to Register, node parser.ASTNode, genData *GeneratorData) error {
-	var err error
-	if node.Kind == parser.Expression && len(node.Children) == 2 {
-		err = genExpression(node, genData)
-		pop(to, genData)
-	} else if node.Kind == parser.Term {
-		err = genTerm(to, node, genData)
-	} else if _, ok := (*genData.vars)[node.Data]; ok {
-		err = genIdentifier(to, node, genData)
-	} else if function, ok := (*genData.funcs)[node.Data]; ok {
-		err = genCall(to, function, node, genData)
-	}
 
-	if err != nil {
-		return err
-	}
+		if expr.Type.IsStruct() {
+			returnAddr := StackAddress{Register: RBP, Offset: genData.returnSlot, Size: "QWORD"}
 
-	return nil
-}
+			err = load(RDX, returnAddr, genData)
+			if err != nil {
+				return err
+			}
 
-func genCall(to Register, function *semantics.Function, node parser.ASTNode, genData *GeneratorData) error {
-	if node.Data == "print" {
-		if node.Children[0].Type != semantics.Char {
-			return fmt.Errorf("print only implemented for char, attempted call with type %v", node.Type.String())
-		}
-
-		genAtom(RAX, node.Children[0], genData)
-		push(RAX, genData)
-
-		move(RAX, OpCode(1), genData)
-		move(RDI, OpCode(1), genData)
-		move(RSI, RSP, genData)
-		move(RDX, OpCode(1), genData)
-		genData.asmFile.WriteString("\tsyscall\n")
-		pop(RAX, genData)
-	} else if node.Data == "exit" {
-		genAtom(RDI, node.Children[0], genData)
-		move(RAX, OpCode(60), genData)
-		genData.asmFile.WriteString("\tsyscall\n")
-	} else {
-		for i := 0; i < function.NumArgs; i++ {
-			err := genAtom(RAX, node.Children[i], genData)
+			err = copyStruct(StackAddress{Register: RDX}, expr.Type.Size(), genData)
 			if err != nil {
 				return err
 			}
 
-			err = move(genData.argRegisters[i], RAX, genData)
+			err = load(RAX, returnAddr, genData)
 			if err != nil {
 				return err
 			}
 		}
 
-		genData.asmFile.WriteString("\tcall " + function.Signature + "\n")
+		err = jump("jmp", ".return", genData)
+		if err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func genExpression(node parser.ASTNode, genData *GeneratorData) error {
-	var generatedLHS, generatedRHS bool = false, false
-	if node.Kind == parser.Expression && len(node.Children) == 2 {
-		if node.Precedence <= node.Children[0].Precedence {
-			err := genExpression(node.Children[0], genData)
-			if err != nil {
-				return err
-			}
-			generatedLHS = true
-		}
-		if node.Precedence <= node.Children[1].Precedence {
-			err := genExpression(node.Children[1], genData)
-			if err != nil {
-				return err
-			}
-			generatedRHS = true
+func genAsm(node parser.ASTNode, genData *GeneratorData) error {
+	// the parser resolved each placeholder, in order, to the variable it names
+	i := 0
+	text := parser.AsmPlaceholder.ReplaceAllStringFunc(node.Data, func(placeholder string) string {
+		name := node.Children[i].Data
+		i++
+		return variableAddress(name, lookup(name, genData)).String()
+	})
+
+	for _, line := range strings.Split(text, "\n") {
+		err := emitLine(line, genData)
+		if err != nil {
+			return err
 		}
+	}
 
-		genBinaryExpression(node, genData)
+	return nil
+}
 
-		if !generatedLHS {
-			err := genExpression(node.Children[0], genData)
-			if err != nil {
-				return err
-			}
-			generatedLHS = true
+func emitLine(line string, genData *GeneratorData) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	// callee-saved registers written by hand still have to be restored
+	for _, reg := range calleeSaved {
+		if asmMentions(line, reg) {
+			clobber(reg, genData)
 		}
-		if !generatedRHS {
-			err := genExpression(node.Children[1], genData)
-			if err != nil {
-				return err
+	}
+
+	if !strings.HasSuffix(line, ":") {
+		line = "\t" + line
+	}
+
+	_, err := genData.asmFile.WriteString(line + "\n")
+
+	return err
+}
+
+// asmMentions reports whether a line of assembly uses reg or one of its narrower views
+func asmMentions(line string, reg Register) bool {
+	words := strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		for _, name := range registerViews[reg] {
+			if word == name {
+				return true
 			}
-			generatedRHS = true
 		}
 	}
 
-	return nil
+	return false
 }
 
-func genBinaryExpression(node parser.ASTNode, genData *GeneratorData) error {
-	switch {
-	case node.Data == "+":
-		err := prepBinaryExpressionCall(node, genData)
-		_, err = genData.asmFile.WriteString("\tadd rax, rbx" + "\n")
-		err = push(RAX, genData)
+func genMatch(node parser.ASTNode, genData *GeneratorData) error {
+	err := genAtom(RAX, node.Children[0], genData)
+	if err != nil {
+		return err
+	}
+
+	arms := node.Children[1:]
+	armLabels := make([]string, len(arms))
+	for i := range arms {
+		armLabels[i] = newLabel(genData)
+	}
+	end := newLabel(genData)
+
+	fallback := end
+	var cases []matchCase
+	for i, arm := range arms {
+		pattern := arm.Children[0]
+		if len(pattern.Children) == 0 {
+			fallback = armLabels[i]
+			continue
+		}
+
+		lo, hi, err := parser.PatternBounds(pattern)
+		if err != nil {
+			return err
+		}
+
+		cases = append(cases, matchCase{lo: lo, hi: hi, label: armLabels[i]})
+	}
+
+	if table, min := buildJumpTable(cases, fallback); table != nil {
+		err = genJumpTable(table, min, fallback, genData)
+	} else {
+		err = genCompareChain(cases, fallback, genData)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, arm := range arms {
+		err = label(armLabels[i], genData)
+		if err != nil {
+			return err
+		}
+
+		err = genScope(arm.Children[1], genData)
+		if err != nil {
+			return err
+		}
+
+		err = jump("jmp", end, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return label(end, genData)
+}
+
+func buildJumpTable(cases []matchCase, fallback string) ([]string, int) {
+	if len(cases) < jumpTableMinCases {
+		return nil, 0
+	}
+
+	min, max := cases[0].lo, cases[0].hi
+	for _, c := range cases {
+		if c.lo < min {
+			min = c.lo
+		}
+		if c.hi > max {
+			max = c.hi
+		}
+	}
+
+	// a negative span means the subtraction overflowed
+	span := max - min + 1
+	if span <= 0 || span > jumpTableMaxSpan {
+		return nil, 0
+	}
+
+	table := make([]string, span)
+	filled := 0
+	for _, c := range cases {
+		for v := c.lo; v <= c.hi; v++ {
+			if table[v-min] == "" {
+				table[v-min] = c.label
+				filled++
+			}
+		}
+	}
+
+	if 2*filled < span {
+		return nil, 0
+	}
+
+	for i := range table {
+		if table[i] == "" {
+			table[i] = fallback
+		}
+	}
+
+	return table, min
+}
+
+func genJumpTable(table []string, min int, fallback string, genData *GeneratorData) error {
+	tableLabel := newLabel(genData)
+
+	err := arithmetic("sub", RAX, min, genData)
+	if err != nil {
+		return err
+	}
+
+	err = arithmetic("cmp", RAX, len(table)-1, genData)
+	if err != nil {
+		return err
+	}
+
+	err = jump("ja", fallback, genData)
+	if err != nil {
+		return err
+	}
+
+	_, err = genData.asmFile.WriteString("\tlea rcx, [rel " + tableLabel + "]\n" + "\tjmp [rcx + rax*8]\n" + "\talign 8\n")
+	if err != nil {
+		return err
+	}
+
+	err = label(tableLabel, genData)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range table {
+		_, err = genData.asmFile.WriteString("\tdq " + entry + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func genCompareChain(cases []matchCase, fallback string, genData *GeneratorData) error {
+	for _, c := range cases {
+		if c.lo == c.hi {
+			err := arithmetic("cmp", RAX, c.lo, genData)
+			if err != nil {
+				return err
+			}
+
+			err = jump("je", c.label, genData)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		next := newLabel(genData)
+
+		err := arithmetic("cmp", RAX, c.lo, genData)
+		if err != nil {
+			return err
+		}
+
+		err = jump("jl", next, genData)
+		if err != nil {
+			return err
+		}
+
+		err = arithmetic("cmp", RAX, c.hi, genData)
+		if err != nil {
+			return err
+		}
+
+		err = jump("jle", c.label, genData)
+		if err != nil {
+			return err
+		}
+
+		err = label(next, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return jump("jmp", fallback, genData)
+}
+
+func genAtom(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	var err error
+	if node.Kind == parser.Expression && len(node.Children) == 2 {
+		err = genExpression(node, genData)
+		pop(to, genData)
+	} else if node.Kind == parser.Term {
+		err = genTerm(to, node, genData)
+	} else if node.Kind == parser.Index {
+		err = genIndex(to, node, genData)
+	} else if node.Kind == parser.Field {
+		err = genField(to, node, genData)
+	} else if node.Kind == parser.Struct {
+		err = genStructLiteral(to, node, genData)
+	} else if node.Kind == parser.Reference {
+		err = genReference(to, node, genData)
+	} else if node.Kind == parser.Dereference {
+		err = genDereference(to, node, genData)
+	} else if lookup(node.Data, genData) != nil {
+		err = genIdentifier(to, node, genData)
+	} else if function, ok := (*genData.funcs)[node.Data]; ok {
+		err = genCall(to, function, node, genData)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func genCall(to Register, function *semantics.Function, node parser.ASTNode, genData *GeneratorData) error {
+	// builtins with a codegen hook are expanded inline, the rest are called through their label
+	if builtin, ok := genData.builtins.builtins[node.Data]; ok && builtin.Gen != nil {
+		return builtin.Gen(to, node, genData)
+	}
+
+	if function.Signature == AllocLabel || function.Signature == FreeLabel {
+		genData.heapUsed = true
+	}
+
+	registers := genData.argRegisters
+	if function.Type.IsStruct() {
+		registers = registers[1:]
+	}
+
+	inRegisters := len(node.Children)
+	if inRegisters > len(registers) {
+		inRegisters = len(registers)
+	}
+	onStack := len(node.Children) - inRegisters
+
+	// rsp has to be 16 byte aligned at the call, the frame is aligned while only rbp is pushed
+	padding := (genData.stackPtrLocation + onStack) % 2
+	if padding != 0 {
+		err := arithmetic("sub", RSP, 8, genData)
+		if err != nil {
+			return err
+		}
+		genData.stackPtrLocation++
+	}
+
+	// arguments passed on the stack are pushed last to first, leaving the first on top,
+	// then the rest are evaluated onto the stack so nested calls cannot clobber argument registers
+	for i := len(node.Children) - 1; i >= inRegisters; i-- {
+		err := genAtom(RAX, node.Children[i], genData)
+		if err != nil {
+			return err
+		}
+
+		err = push(RAX, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range node.Children[:inRegisters] {
+		err := genAtom(RAX, arg, genData)
+		if err != nil {
+			return err
+		}
+
+		err = push(RAX, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := inRegisters - 1; i >= 0; i-- {
+		err := pop(registers[i], genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// struct results are copied by the callee into space reserved in the caller's frame
+	if function.Type.IsStruct() {
+		err := lea(RDI, StackAddress{Register: RBP, Offset: allocate(function.Type.Size(), genData)}, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// variadic C functions expect the number of vector registers used in al
+	if function.Extern {
+		genData.asmFile.WriteString("\txor eax, eax\n")
+	}
+
+	genData.asmFile.WriteString("\tcall " + function.Signature + "\n")
+
+	if onStack+padding > 0 {
+		err := arithmetic("add", RSP, 8*(onStack+padding), genData)
+		if err != nil {
+			return err
+		}
+		genData.stackPtrLocation -= onStack + padding
+	}
+
+	if to != RAX {
+		return move(to, RAX, genData)
+	}
+
+	return nil
+}
+
+func genExpression(node parser.ASTNode, genData *GeneratorData) error {
+	// evaluates operands that cannot be loaded directly onto the stack, lhs first
+	for _, child := range node.Children {
+		if child.IsOperator() {
+			err := genExpression(child, genData)
+			if err != nil {
+				return err
+			}
+		} else if !isLeaf(child) {
+			err := genAtom(RAX, child, genData)
+			if err != nil {
+				return err
+			}
+
+			err = push(RAX, genData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return genBinaryExpression(node, genData)
+}
+
+func genBinaryExpression(node parser.ASTNode, genData *GeneratorData) error {
+	switch {
+	case node.Data == "+":
+		err := prepBinaryExpressionCall(node, genData)
+		_, err = genData.asmFile.WriteString("\tadd rax, rbx" + "\n")
+		err = push(RAX, genData)
 
 		if err != nil {
 			return err
@@ -424,97 +1172,639 @@ func genBinaryExpression(node parser.ASTNode, genData *GeneratorData) error {
 		if err != nil {
 			return err
 		}
-	case node.Data == "*":
-		err := prepBinaryExpressionCall(node, genData)
-		_, err = genData.asmFile.WriteString("\tmul rbx" + "\n")
-		err = push(RAX, genData)
+	case node.Data == "*":
+		err := prepBinaryExpressionCall(node, genData)
+		_, err = genData.asmFile.WriteString("\tmul rbx" + "\n")
+		err = push(RAX, genData)
+
+		if err != nil {
+			return err
+		}
+	case node.Data == "/":
+		err := prepBinaryExpressionCall(node, genData)
+		_, err = genData.asmFile.WriteString("\tcqo\n\tidiv rbx" + "\n")
+		err = push(RAX, genData)
+
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("Expression " + node.Data + "not implemented")
+	}
+
+	return nil
+}
+
+func genTerm(register Register, node parser.ASTNode, genData *GeneratorData) error {
+	var err error
+
+	switch node.Type {
+	case semantics.Int:
+		err = genIntLiteral(register, node, genData)
+		break
+	case semantics.Char:
+		err = genCharLiteral(register, node, genData)
+		break
+	case semantics.Null:
+		err = move(register, IntLiteral(0), genData)
+		break
+	}
+
+	return err
+}
+
+func genIntLiteral(register Register, node parser.ASTNode, genData *GeneratorData) error {
+	data, err := strconv.Atoi(node.Data)
+	if err != nil {
+		return err
+	}
+
+	err = move(register, IntLiteral(data), genData)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func genCharLiteral(register Register, node parser.ASTNode, genData *GeneratorData) error {
+	if strings.Contains(node.Data, "\\") && node.Data != "'\\n'" {
+		value, err := semantics.LiteralValue(node.Data, semantics.Char)
+		if err != nil {
+			return err
+		}
+
+		return move(register, IntLiteral(value), genData)
+	}
+
+	return move(register, CharLiteral(node.Data[1:len(node.Data)-1]), genData)
+}
+
+func genIdentifier(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	if variable := lookup(node.Data, genData); variable != nil {
+		if variable.Constant {
+			return move(to, IntLiteral(variable.Value), genData)
+		}
+
+		if variable.Type.IsStruct() {
+			return lea(to, variableAddress(node.Data, variable), genData)
+		}
+
+		return load(to, variableAddress(node.Data, variable), genData)
+	}
+
+	return fmt.Errorf("Variable: '%v' not declared", node.Data)
+}
+
+func genIndex(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	addr, err := genElementAddress(node, genData)
+	if err != nil {
+		return err
+	}
+
+	return load(to, addr, genData)
+}
+
+func genElementAddress(node parser.ASTNode, genData *GeneratorData) (StackAddress, error) {
+	// indices not known at compile time are evaluated into rcx, clobbering rax
+	variable := lookup(node.Data, genData)
+	if variable == nil {
+		return StackAddress{}, fmt.Errorf("Array: '%v' not declared", node.Data)
+	}
+
+	addr := variableAddress(node.Data, variable)
+	index := node.Children[0]
+
+	if index.Kind == parser.Term {
+		i, err := semantics.LiteralValue(index.Data, index.Type)
+		if err != nil {
+			return StackAddress{}, err
+		}
+
+		addr.Offset += i * variable.Type.Size()
+		return addr, nil
+	}
+
+	err := genAtom(RAX, index, genData)
+	if err != nil {
+		return StackAddress{}, err
+	}
+
+	if genData.boundsChecks {
+		genData.boundsChecked = true
+
+		err = arithmetic("cmp", RAX, variable.Length, genData)
+		if err != nil {
+			return StackAddress{}, err
+		}
+
+		err = jump("jae", boundsErrorLabel, genData)
+		if err != nil {
+			return StackAddress{}, err
+		}
+	}
+
+	err = move(RCX, RAX, genData)
+	if err != nil {
+		return StackAddress{}, err
+	}
+
+	// rip relative addresses cannot be indexed
+	if addr.Label != "" {
+		err = lea(RDX, addr, genData)
+		if err != nil {
+			return StackAddress{}, err
+		}
+
+		addr = StackAddress{Register: RDX, Size: addr.Size}
+	}
+
+	addr.Index = RCX
+	addr.Scale = variable.Type.Size()
+
+	return addr, nil
+}
+
+func genField(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	addr, err := genFieldAddress(node, genData)
+	if err != nil {
+		return err
+	}
+
+	if node.Type.IsStruct() {
+		return lea(to, addr, genData)
+	}
+
+	return load(to, addr, genData)
+}
+
+func genFieldAddress(node parser.ASTNode, genData *GeneratorData) (StackAddress, error) {
+	// fields of values that are not variables are addressed through rax
+	base := node.Children[0]
+
+	field, err := base.Type.Field(node.Data)
+	if err != nil {
+		return StackAddress{}, err
+	}
+
+	var addr StackAddress
+	if base.Kind == parser.Identifier {
+		addr = variableAddress(base.Data, lookup(base.Data, genData))
+	} else if base.Kind == parser.Field {
+		addr, err = genFieldAddress(base, genData)
+	} else {
+		err = genAtom(RAX, base, genData)
+		addr = StackAddress{Register: RAX}
+	}
+	if err != nil {
+		return StackAddress{}, err
+	}
+
+	addr.Offset += field.Offset
+	addr.Size = bytesToWord(field.Type.Size())
+
+	return addr, nil
+}
+
+func genReference(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	addr, err := genLvalueAddress(node.Children[0], genData)
+	if err != nil {
+		return err
+	}
+
+	return lea(to, addr, genData)
+}
+
+func genDereference(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	// structs are referred to by their address, so only scalars are loaded
+	err := genAtom(RAX, node.Children[0], genData)
+	if err != nil {
+		return err
+	}
+
+	if node.Type.IsStruct() {
+		if to != RAX {
+			return move(to, RAX, genData)
+		}
+
+		return nil
+	}
+
+	return load(to, StackAddress{Register: RAX, Size: bytesToWord(node.Type.Size())}, genData)
+}
+
+func genLvalueAddress(node parser.ASTNode, genData *GeneratorData) (StackAddress, error) {
+	// clobbers rax and rcx, the returned address never uses rax
+	var addr StackAddress
+	var err error
+
+	switch node.Kind {
+	case parser.Identifier:
+		variable := lookup(node.Data, genData)
+		if variable == nil {
+			return StackAddress{}, fmt.Errorf("Variable: '%v' not declared", node.Data)
+		}
+
+		addr = variableAddress(node.Data, variable)
+	case parser.Index:
+		addr, err = genElementAddress(node, genData)
+	case parser.Field:
+		addr, err = genFieldAddress(node, genData)
+	case parser.Dereference:
+		err = genAtom(RAX, node.Children[0], genData)
+		addr = StackAddress{Register: RAX, Size: bytesToWord(node.Type.Size())}
+	default:
+		return StackAddress{}, fmt.Errorf("Cannot take the address of '%v'", node.Data)
+	}
+	if err != nil {
+		return StackAddress{}, err
+	}
+
+	if addr.Register == RAX {
+		err = move(RDX, RAX, genData)
+		addr.Register = RDX
+	}
+
+	return addr, err
+}
+
+func genAssignment(lhs parser.ASTNode, rhs parser.ASTNode, genData *GeneratorData) error {
+	// the value is kept on the stack while the address is computed
+	err := genAtom(RAX, rhs, genData)
+	if err != nil {
+		return err
+	}
+
+	err = push(RAX, genData)
+	if err != nil {
+		return err
+	}
+
+	addr, err := genLvalueAddress(lhs, genData)
+	if err != nil {
+		return err
+	}
+
+	err = pop(RAX, genData)
+	if err != nil {
+		return err
+	}
+
+	if lhs.Type.IsStruct() {
+		return copyStruct(addr, lhs.Type.Size(), genData)
+	}
+
+	return store(addr, RAX, genData)
+}
+
+func genStructLiteral(to Register, node parser.ASTNode, genData *GeneratorData) error {
+	base := StackAddress{Register: RBP, Offset: allocate(node.Type.Size(), genData)}
+
+	if len(node.Children) < len(node.Type.Fields()) {
+		for offset := 0; offset < node.Type.Size(); offset += 8 {
+			slot := base
+			slot.Offset += offset
+			slot.Size = "QWORD"
+
+			err := move(slot, IntLiteral(0), genData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, child := range node.Children {
+		field, err := node.Type.Field(child.Data)
+		if err != nil {
+			return err
+		}
+
+		addr := base
+		addr.Offset += field.Offset
+		addr.Size = bytesToWord(field.Type.Size())
+
+		err = genAtom(RAX, child.Children[0], genData)
+		if err != nil {
+			return err
+		}
+
+		if field.Type.IsStruct() {
+			err = copyStruct(addr, field.Type.Size(), genData)
+		} else {
+			err = store(addr, RAX, genData)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return lea(to, base, genData)
+}
+
+func genLocal(node parser.ASTNode, genData *GeneratorData) {
+	variable := lookup(node.Data, genData)
+	variable.StackLocation = allocate(variable.Size(), genData)
+}
+
+func genArrayLiteral(name string, variable *semantics.Variable, node parser.ASTNode, genData *GeneratorData) error {
+	if !variable.IsGlobal {
+		variable.StackLocation = allocate(variable.Size(), genData)
+	}
 
+	// elements missing from the literal are zeroed
+	for i := 0; i < variable.Length; i++ {
+		var err error
+		if i < len(node.Children) {
+			err = genAtom(RAX, node.Children[i], genData)
+		} else {
+			err = move(RAX, IntLiteral(0), genData)
+		}
 		if err != nil {
 			return err
 		}
-	case node.Data == "/":
-		err := prepBinaryExpressionCall(node, genData)
-		_, err = genData.asmFile.WriteString("\tdiv rbx" + "\n")
-		err = push(RAX, genData)
 
+		addr := variableAddress(name, variable)
+		addr.Offset += i * variable.Type.Size()
+
+		err = store(addr, RAX, genData)
 		if err != nil {
 			return err
 		}
-	default:
-		return errors.New("Expression " + node.Data + "not implemented")
 	}
 
 	return nil
 }
 
-func genTerm(register Register, node parser.ASTNode, genData *GeneratorData) error {
-	var err error
+func genArg(from Register, node parser.ASTNode, genData *GeneratorData) error {
+	if variable := lookup(node.Data, genData); variable != nil {
+		variable.StackLocation = allocate(variable.Size(), genData)
 
-	switch node.Type {
-	case semantics.Int:
-		err = genIntLiteral(register, node, genData)
-		break
-	case semantics.Char:
-		err = genCharLiteral(register, node, genData)
-		break
+		return store(variableAddress(node.Data, variable), from, genData)
+	}
+
+	return fmt.Errorf("Variable: '%v' already declared in outer scope", node.Data)
+}
+
+func genStart(genData *GeneratorData) error {
+	if genData.library {
+		return genInitArray(genData)
+	}
+
+	if genData.libc {
+		return genLibcMain(genData)
+	}
+
+	// the entry point initializes globals, then exits with the value returned by main
+	err := label("_start", genData)
+	if err != nil {
+		return err
+	}
+
+	if genData.hasInit {
+		_, err = genData.asmFile.WriteString("\tcall " + initLabel + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	main, ok := (*genData.funcs)["main"]
+	if !ok {
+		return genDefaultExit(genData.asmFile, genData)
+	}
+
+	_, err = genData.asmFile.WriteString("\tcall " + main.Signature + "\n")
+	if err != nil {
+		return err
+	}
+
+	if main.Type == semantics.Void {
+		err = move(RDI, IntLiteral(0), genData)
+	} else {
+		err = move(RDI, RAX, genData)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = move(RAX, OpCode(60), genData)
+	if err != nil {
+		return err
 	}
 
+	_, err = genData.asmFile.WriteString("\tsyscall\n")
+
 	return err
 }
 
-func genIntLiteral(register Register, node parser.ASTNode, genData *GeneratorData) error {
-	data, err := strconv.Atoi(node.Data)
+func genLibcMain(genData *GeneratorData) error {
+	// the C runtime calls main and exits with its result
+	err := label("main", genData)
 	if err != nil {
 		return err
 	}
 
-	err = move(register, IntLiteral(data), genData)
+	err = arithmetic("sub", RSP, 8, genData)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if genData.hasInit {
+		_, err = genData.asmFile.WriteString("\tcall " + initLabel + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	main, ok := (*genData.funcs)["main"]
+	if ok {
+		_, err = genData.asmFile.WriteString("\tcall " + main.Signature + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ok || main.Type == semantics.Void {
+		err = move(RAX, IntLiteral(0), genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = arithmetic("add", RSP, 8, genData)
+	if err != nil {
+		return err
+	}
+
+	_, err = genData.asmFile.WriteString("\tret\n")
+
+	return err
 }
 
-func genCharLiteral(register Register, node parser.ASTNode, genData *GeneratorData) error {
-	return move(register, CharLiteral(node.Data[1:len(node.Data)-1]), genData)
+func genInitArray(genData *GeneratorData) error {
+	if !genData.hasInit {
+		return nil
+	}
+
+	// without a main of our own, the C runtime initializes globals before its main
+	_, err := genData.asmFile.WriteString("section .init_array\nalign 8\n\tdq " + initLabel + "\nsection .text\n")
+
+	return err
 }
 
-func genIdentifier(to Register, node parser.ASTNode, genData *GeneratorData) error {
-	if variable, ok := (*genData.vars)[node.Data]; ok {
-		offset := variable.StackLocation
-		var addr = StackAddress{
-			Offset:   offset,
-			Register: RBP,
-			Size:     bytesToWord(variable.Type.Size()),
+// NeedsLibc reports whether a program calls extern functions and so has to be linked against libc
+func NeedsLibc(funcs *semantics.FuncMap) bool {
+	for _, function := range *funcs {
+		if function.Extern {
+			return true
 		}
+	}
 
-		return move(to, addr, genData)
+	return false
+}
+
+func genExports(genData *GeneratorData) error {
+	var names []string
+	for _, function := range *genData.funcs {
+		if function.Exported {
+			names = append(names, function.Signature)
+		}
 	}
 
-	return fmt.Errorf("Variable: '%v' not declared", node.Data)
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, err := genData.asmFile.WriteString("global " + name + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func genArg(from Register, node parser.ASTNode, genData *GeneratorData) error {
-	if variable, ok := (*genData.vars)[node.Data]; ok {
-		variable.StackLocation = genData.stackPtrLocation
-		offset := variable.StackLocation
-		var addr = StackAddress{
-			Offset:   offset,
-			Register: RBP,
-			Size:     bytesToWord(variable.Type.Size()),
+func genExterns(genData *GeneratorData) error {
+	var names []string
+	for _, function := range *genData.funcs {
+		if function.Extern {
+			names = append(names, function.Signature)
 		}
+	}
+
+	// the exit builtin calls into libc when linked against it
+	if _, ok := (*genData.funcs)["exit"]; ok && genData.libc {
+		names = append(names, "exit")
+	}
 
-		err := move(addr, from, genData)
-		genData.stackPtrLocation += 1
+	sort.Strings(names)
 
-		return err
+	for i, name := range names {
+		// modules declaring the same C function share it
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+
+		_, err := genData.asmFile.WriteString("extern " + name + "\n")
+		if err != nil {
+			return err
+		}
 	}
 
-	return fmt.Errorf("Variable: '%v' already declared in outer scope", node.Data)
+	return nil
+}
+
+func genGlobals(genData *GeneratorData) error {
+	// initialized globals are emitted into .data, the rest are zeroed in .bss
+	for _, section := range []string{".data", ".bss"} {
+		header := false
+		for _, g := range genData.globals {
+			if (g.values != nil) != (section == ".data") {
+				continue
+			}
+
+			if !header {
+				_, err := genData.asmFile.WriteString("section " + section + "\n")
+				if err != nil {
+					return err
+				}
+				header = true
+			}
+
+			variable := (*genData.vars)[g.name]
+
+			_, err := genData.asmFile.WriteString("align " + strconv.Itoa(variable.Type.Alignment()) + "\n" + globalLabel(g.name) + ":\n")
+			if err != nil {
+				return err
+			}
+
+			if g.values == nil {
+				_, err = genData.asmFile.WriteString("\tresb " + strconv.Itoa(variable.Size()) + "\n")
+			} else {
+				_, err = genData.asmFile.WriteString("\t" + dataDirective(variable.Type.Size()) + " " + strings.Join(g.values, ", ") + "\n")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func staticValues(decl parser.ASTNode, value parser.ASTNode, genData *GeneratorData) ([]string, bool) {
+	// returns the initial values of a global whose initializer is made of literals
+	variable := (*genData.vars)[decl.Data]
+
+	elements := []parser.ASTNode{value}
+	if variable.IsArray() {
+		elements = value.Children
+	} else if variable.Type.IsStruct() {
+		return nil, false
+	}
+
+	values := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if element.Kind != parser.Term {
+			return nil, false
+		}
+
+		if element.Type == semantics.Null {
+			values = append(values, "0")
+			continue
+		}
+
+		v, err := semantics.LiteralValue(element.Data, element.Type)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, strconv.Itoa(v))
+	}
+
+	// elements missing from array literals are zeroed
+	for len(values) < variable.Length {
+		values = append(values, "0")
+	}
+
+	return values, true
+}
+
+func globalLabel(name string) string {
+	return "__global_" + semantics.Symbol(name)
 }
 
-func genDefaultExit(asmFile *os.File, genData *GeneratorData) error {
+func dataDirective(size int) string {
+	switch {
+	case size <= 1:
+		return "db"
+	case size <= 2:
+		return "dw"
+	case size <= 4:
+		return "dd"
+	default:
+		return "dq"
+	}
+}
+
+func genDefaultExit(asmFile io.StringWriter, genData *GeneratorData) error {
 	err := move(RAX, OpCode(60), genData)
 	err = move(RDI, OpCode(0), genData)
 	if err != nil {
@@ -526,19 +1816,49 @@ func genDefaultExit(asmFile *os.File, genData *GeneratorData) error {
 	return nil
 }
 
+func genBoundsError(genData *GeneratorData) error {
+	message := "index out of range"
+
+	err := label(boundsErrorLabel, genData)
+	if err != nil {
+		return err
+	}
+
+	move(RAX, OpCode(1), genData)
+	move(RDI, OpCode(2), genData)
+	genData.asmFile.WriteString("\tlea rsi, [rel .message]\n")
+	move(RDX, OpCode(len(message)+1), genData)
+	genData.asmFile.WriteString("\tsyscall\n")
+	move(RAX, OpCode(60), genData)
+	move(RDI, OpCode(1), genData)
+	genData.asmFile.WriteString("\tsyscall\n")
+
+	_, err = genData.asmFile.WriteString(".message:\n\tdb \"" + message + "\", 10\n")
+
+	return err
+}
+
 func prepBinaryExpressionCall(node parser.ASTNode, genData *GeneratorData) error {
 	var err error
-	if node.Children[0].IsOperator() {
+	if !isLeaf(node.Children[1]) {
+		err = pop(RBX, genData)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !isLeaf(node.Children[0]) {
 		err = pop(RAX, genData)
 	} else if node.Children[0].Kind == parser.Term {
 		err = genTerm(RAX, node.Children[0], genData)
 	} else if node.Children[0].Kind == parser.Identifier {
 		err = genIdentifier(RAX, node.Children[0], genData)
 	}
+	if err != nil {
+		return err
+	}
 
-	if node.Children[1].IsOperator() {
-		err = pop(RBX, genData)
-	} else if node.Children[1].Kind == parser.Term {
+	if node.Children[1].Kind == parser.Term {
 		err = genTerm(RBX, node.Children[1], genData)
 	} else if node.Children[1].Kind == parser.Identifier {
 		err = genIdentifier(RBX, node.Children[1], genData)
@@ -547,7 +1867,51 @@ func prepBinaryExpressionCall(node parser.ASTNode, genData *GeneratorData) error
 	return err
 }
 
+func isLeaf(node parser.ASTNode) bool {
+	// terms and identifiers can be loaded into any register without clobbering others
+	return node.Kind == parser.Term || node.Kind == parser.Identifier
+}
+
+func arithmetic(op string, reg Register, value int, genData *GeneratorData) error {
+	// x86-64 arithmetic only takes sign extended 32 bit immediates
+	operand := IntLiteral(value).String()
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		err := move(RDX, IntLiteral(value), genData)
+		if err != nil {
+			return err
+		}
+		operand = RDX.String()
+	} else if op == "sub" && value == 0 {
+		return nil
+	}
+
+	_, err := genData.asmFile.WriteString("\t" + op + " " + reg.String() + ", " + operand + "\n")
+
+	return err
+}
+
+func newLabel(genData *GeneratorData) string {
+	genData.labelCount++
+	return ".L" + strconv.Itoa(genData.labelCount)
+}
+
+func label(name string, genData *GeneratorData) error {
+	_, err := genData.asmFile.WriteString(name + ":\n")
+
+	return err
+}
+
+func jump(instruction string, label string, genData *GeneratorData) error {
+	_, err := genData.asmFile.WriteString("\t" + instruction + " " + label + "\n")
+
+	return err
+}
+
 func move[T1 movable, T2 movable](to T1, from T2, genData *GeneratorData) error {
+	if reg, ok := any(to).(Register); ok {
+		clobber(reg, genData)
+	}
+
 	_, err := genData.asmFile.WriteString("\tmov " + to.String() + ", " + from.String() + "\n")
 
 	if err != nil {
@@ -569,6 +1933,7 @@ func push[T pushable](val T, genData *GeneratorData) error {
 
 func pop(register Register, genData *GeneratorData) error {
 	genData.stackPtrLocation -= 1
+	clobber(register, genData)
 
 	_, err := genData.asmFile.WriteString("\tpop " + register.String() + "\n")
 	if err != nil {
@@ -578,22 +1943,103 @@ func pop(register Register, genData *GeneratorData) error {
 	return nil
 }
 
-func reassign(ident parser.ASTNode, genData *GeneratorData) error {
-	variable := (*genData.vars)[ident.Data]
-	offset := variable.StackLocation
-	var addr = StackAddress{
+func load(to Register, addr StackAddress, genData *GeneratorData) error {
+	// values narrower than a register are zero extended
+	if addr.Size == "QWORD" {
+		return move(to, addr, genData)
+	}
+
+	clobber(to, genData)
+
+	_, err := genData.asmFile.WriteString("\tmovzx " + to.String() + ", " + addr.String() + "\n")
+
+	return err
+}
+
+func store(addr StackAddress, from Register, genData *GeneratorData) error {
+	if addr.Size == "BYTE" {
+		from = from.Low()
+	}
+
+	return move(addr, from, genData)
+}
+
+func lea(to Register, addr StackAddress, genData *GeneratorData) error {
+	addr.Size = ""
+	clobber(to, genData)
+
+	_, err := genData.asmFile.WriteString("\tlea " + to.String() + ", " + addr.String() + "\n")
+
+	return err
+}
+
+func copyStruct(to StackAddress, size int, genData *GeneratorData) error {
+	// copies size bytes from the address in rax, clobbering rcx, rsi and rdi
+	err := move(RSI, RAX, genData)
+	if err != nil {
+		return err
+	}
+
+	err = lea(RDI, to, genData)
+	if err != nil {
+		return err
+	}
+
+	err = move(RCX, IntLiteral(size), genData)
+	if err != nil {
+		return err
+	}
+
+	_, err = genData.asmFile.WriteString("\trep movsb\n")
+
+	return err
+}
+
+func allocate(size int, genData *GeneratorData) int {
+	// reserves whole stack slots in the current frame, returns the offset of the lowest byte from rbp
+	genData.frameSize += (size + 7) / 8 * 8
+
+	return -genData.frameSize
+}
+
+// lookup resolves name to a parameter or local of the function being generated before looking for a global.
+// Locals cannot shadow the globals of their module, the parser rejects them, so a local only takes
+// precedence over a global of the entry program of the same name, which module functions cannot see
+func lookup(name string, genData *GeneratorData) *semantics.Variable {
+	if function, ok := (*genData.funcs)[genData.function]; ok {
+		if variable, ok := function.Vars[name]; ok {
+			return variable
+		}
+	}
+
+	return (*genData.vars)[name]
+}
+
+func variableAddress(name string, variable *semantics.Variable) StackAddress {
+	if variable.IsGlobal {
+		return StackAddress{
+			Label: globalLabel(name),
+			Size:  bytesToWord(variable.Type.Size()),
+		}
+	}
+
+	return StackAddress{
 		Register: RBP,
-		Offset:   offset,
+		Offset:   variable.StackLocation,
 		Size:     bytesToWord(variable.Type.Size()),
 	}
+}
 
-	move(addr, RAX, genData)
+func reassign(ident parser.ASTNode, genData *GeneratorData) error {
+	variable := lookup(ident.Data, genData)
 
-	return nil
+	return store(variableAddress(ident.Data, variable), RAX, genData)
 }
 
 func bytesToWord(bytes int) string {
 	switch {
+	case bytes <= 1:
+		return "BYTE"
 	case bytes <= 2:
 		return "WORD"
 	default:
@@ -0,0 +1,145 @@
+package generator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/GenM4/penguin/pkg/semantics"
+)
+
+// HasExports reports whether a program exports functions to C
+func HasExports(funcs *semantics.FuncMap) bool {
+	for _, function := range *funcs {
+		if function.Exported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsLibrary reports whether a program is only meant to be linked into C code, having exports but no main
+func IsLibrary(funcs *semantics.FuncMap) bool {
+	_, hasMain := (*funcs)["main"]
+
+	return !hasMain && HasExports(funcs)
+}
+
+// GenerateHeader writes a C header declaring the exported functions of a program.
+// Structs are only visible through pointers, so they are declared as incomplete types
+func GenerateHeader(base string, funcs *semantics.FuncMap, out io.StringWriter) error {
+	var names []string
+	for name, function := range *funcs {
+		if function.Exported {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var structs []string
+	var decls []string
+	for _, name := range names {
+		function := (*funcs)[name]
+
+		var params []string
+		for _, param := range function.Params {
+			params = append(params, cDeclaration(param.Type, param.Name, &structs))
+		}
+		if len(params) == 0 {
+			params = append(params, "void")
+		}
+
+		decls = append(decls, cDeclaration(function.Type, function.Signature, &structs)+"("+strings.Join(params, ", ")+");\n")
+	}
+
+	guard := headerGuard(base)
+
+	var header strings.Builder
+	header.WriteString("#ifndef " + guard + "\n#define " + guard + "\n\n")
+	header.WriteString("/* Generated by penguin, do not edit */\n\n")
+
+	if len(structs) > 0 {
+		sort.Strings(structs)
+		for _, name := range structs {
+			header.WriteString("struct " + name + ";\n")
+		}
+		header.WriteString("\n")
+	}
+
+	for _, decl := range decls {
+		header.WriteString(decl)
+	}
+
+	header.WriteString("\n#endif\n")
+
+	_, err := out.WriteString(header.String())
+
+	return err
+}
+
+// cDeclaration declares name with the C equivalent of typ, recording structs it refers to
+func cDeclaration(typ semantics.Type, name string, structs *[]string) string {
+	if !typ.IsPointer() {
+		return cType(typ, structs) + " " + name
+	}
+
+	elem := strings.TrimSuffix(cDeclaration(typ.Elem(), "", structs), " ")
+
+	// a pointer to immutable data becomes a pointer to const
+	if !typ.ElemMutable() {
+		if typ.Elem().IsPointer() {
+			elem += " const"
+		} else {
+			elem = "const " + elem
+		}
+	}
+
+	return elem + " *" + name
+}
+
+func cType(typ semantics.Type, structs *[]string) string {
+	switch typ {
+	case semantics.Int:
+		// penguin ints are 64 bits wide
+		return "long"
+	case semantics.Char:
+		return "char"
+	case semantics.Byte:
+		return "unsigned char"
+	case semantics.Void:
+		return "void"
+	}
+
+	if typ.IsStruct() {
+		// structs of modules are named after their module path
+		name := cIdentifier(typ.String())
+		for _, seen := range *structs {
+			if seen == name {
+				return "struct " + name
+			}
+		}
+		*structs = append(*structs, name)
+
+		return "struct " + name
+	}
+
+	panic(fmt.Errorf("Type %v has no C equivalent", typ.String()))
+}
+
+func headerGuard(base string) string {
+	return cIdentifier("PENGUIN_" + strings.ToUpper(base) + "_H")
+}
+
+func cIdentifier(name string) string {
+	runes := []rune(name)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			runes[i] = '_'
+		}
+	}
+
+	return string(runes)
+}
@@ -0,0 +1,142 @@
+package generator
+
+import "fmt"
+
+// Labels of the heap runtime routines, called like any other penguin function
+const (
+	AllocLabel = "__alloc"
+	FreeLabel  = "__free"
+)
+
+const (
+	// Small blocks are rounded up to one of heapClasses powers of two starting at
+	// heapMinBlock bytes, including the heapHeader bytes that record their class.
+	// Each free list is refilled with a heapChunk byte mapping when it runs empty.
+	// Blocks start on their size in a page aligned mapping, so the 16 byte header
+	// leaves the pointers returned 16 byte aligned, like those of malloc
+	heapClasses  = 8
+	heapHeader   = 16
+	heapMinBlock = 32
+	heapChunk    = 65536
+	heapMaxSmall = heapMinBlock << (heapClasses - 1)
+
+	heapFreeLists = "__heap_free"
+
+	sysMmap   = 9
+	sysMunmap = 11
+
+	mmapProt  = 0x3  // PROT_READ | PROT_WRITE
+	mmapFlags = 0x22 // MAP_PRIVATE | MAP_ANONYMOUS
+)
+
+// heapAlloc returns the address of at least rdi usable bytes in rax, or 0 when mmap fails.
+// Larger blocks get their own mapping and record its length in the header instead of a class
+const heapAlloc = `%[1]v:
+	lea rax, [rdi + %[9]v]
+	cmp rax, %[2]v
+	ja .large
+	xor ecx, ecx
+	mov edx, %[3]v
+.class:
+	cmp rax, rdx
+	jbe .small
+	shl rdx, 1
+	inc rcx
+	jmp .class
+.small:
+	lea rsi, [rel %[4]v]
+	mov rax, QWORD [rsi + rcx*8]
+	test rax, rax
+	jnz .pop
+	push rcx
+	push rdx
+	mov rax, %[5]v
+	xor edi, edi
+	mov esi, %[6]v
+	mov edx, %[7]v
+	mov r10, %[8]v
+	mov r8, -1
+	xor r9d, r9d
+	syscall
+	pop rdx
+	pop rcx
+	cmp rax, -4096
+	ja .fail
+	lea r8, [rax + %[6]v]
+	sub r8, rdx
+	mov rdi, rax
+.link:
+	cmp rdi, r8
+	jae .last
+	lea r9, [rdi + rdx]
+	mov QWORD [rdi], r9
+	mov rdi, r9
+	jmp .link
+.last:
+	mov QWORD [rdi], 0
+	lea rsi, [rel %[4]v]
+.pop:
+	mov rdi, QWORD [rax]
+	mov QWORD [rsi + rcx*8], rdi
+	mov QWORD [rax], rcx
+	add rax, %[9]v
+	ret
+.large:
+	add rax, 4095
+	and rax, -4096
+	push rax
+	mov rsi, rax
+	mov rax, %[5]v
+	xor edi, edi
+	mov edx, %[7]v
+	mov r10, %[8]v
+	mov r8, -1
+	xor r9d, r9d
+	syscall
+	pop rsi
+	cmp rax, -4096
+	ja .fail
+	mov QWORD [rax], rsi
+	add rax, %[9]v
+	ret
+.fail:
+	xor eax, eax
+	ret
+`
+
+// heapFree returns the block at rdi to its free list, or unmaps it if it was a large block
+const heapFree = `%[1]v:
+	test rdi, rdi
+	jz .done
+	sub rdi, %[5]v
+	mov rcx, QWORD [rdi]
+	cmp rcx, %[2]v
+	jae .large
+	lea rsi, [rel %[3]v]
+	mov rax, QWORD [rsi + rcx*8]
+	mov QWORD [rdi], rax
+	mov QWORD [rsi + rcx*8], rdi
+.done:
+	ret
+.large:
+	mov rsi, rcx
+	mov rax, %[4]v
+	syscall
+	ret
+`
+
+func genHeapRuntime(genData *GeneratorData) error {
+	_, err := genData.asmFile.WriteString(fmt.Sprintf(heapAlloc, AllocLabel, heapMaxSmall, heapMinBlock, heapFreeLists, sysMmap, heapChunk, mmapProt, mmapFlags, heapHeader))
+	if err != nil {
+		return err
+	}
+
+	_, err = genData.asmFile.WriteString(fmt.Sprintf(heapFree, FreeLabel, heapClasses, heapFreeLists, sysMunmap, heapHeader))
+	if err != nil {
+		return err
+	}
+
+	_, err = genData.asmFile.WriteString(fmt.Sprintf("section .bss\nalign 8\n%v:\n\tresq %v\n", heapFreeLists, heapClasses))
+
+	return err
+}
@@ -0,0 +1,154 @@
+// Package module loads a program together with the modules it imports
+package module
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/GenM4/penguin/pkg/parser"
+	"github.com/GenM4/penguin/pkg/semantics"
+	"github.com/GenM4/penguin/pkg/tokenizer"
+)
+
+// Extension is appended to a module path to find its source file
+const Extension = ".pn"
+
+// every part of a module path has to be an identifier, as the last one names the module in code
+var pathPart = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+type loader struct {
+	dirs    []string          // directories module paths are looked up in, in order
+	modules map[string]string // path of every module loaded or being loaded by its file
+	done    map[string]bool   // modules that are parsed
+	program *parser.ASTNode
+	vars    *semantics.VarMap
+	funcs   *semantics.FuncMap
+}
+
+// Load parses the program in file, already tokenized, and every module it imports directly or not.
+// Import paths are looked up in dirs, or the directory of the program if none are given, wherever they appear,
+// so one path names one module. Modules are parsed before the files importing them
+func Load(file string, dirs []string, tokens tokenizer.TokenStack, vars *semantics.VarMap, funcs *semantics.FuncMap) *parser.ASTNode {
+	if len(dirs) == 0 {
+		dirs = []string{filepath.Dir(file)}
+	}
+
+	loader := loader{
+		dirs:    dirs,
+		modules: make(map[string]string),
+		done:    make(map[string]bool),
+		program: &parser.ASTNode{Kind: parser.Program},
+		vars:    vars,
+		funcs:   funcs,
+	}
+
+	err := loader.load(file, "", tokens)
+	if err != nil {
+		panic(err)
+	}
+
+	return loader.program
+}
+
+func (loader *loader) load(file string, module string, tokens tokenizer.TokenStack) error {
+	loader.modules[filepath.Clean(file)] = module
+
+	paths, err := parser.Imports(&tokens)
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+
+	imports := make(map[string]string)
+	for _, tok := range paths {
+		imported, err := loader.resolve(tok.Data)
+		if err != nil {
+			return fmt.Errorf("%v: Line %v: %v", file, tok.Line, err)
+		}
+
+		name := path.Base(imported)
+		if _, ok := imports[name]; ok {
+			return fmt.Errorf("%v: Line %v: Module name '%v' imported twice", file, tok.Line, name)
+		}
+		imports[name] = imported
+
+		importedFile, err := loader.find(imported)
+		if err != nil {
+			return fmt.Errorf("%v: Line %v: %v", file, tok.Line, err)
+		}
+
+		if seen, ok := loader.modules[importedFile]; ok {
+			if !loader.done[seen] {
+				return fmt.Errorf("%v: Line %v: Import cycle through module '%v'", file, tok.Line, imported)
+			}
+
+			continue
+		}
+
+		dat, err := os.ReadFile(importedFile)
+		if err != nil {
+			return fmt.Errorf("%v: Line %v: %v", file, tok.Line, err)
+		}
+
+		err = loader.load(importedFile, imported, tokenizer.Tokenize(dat))
+		if err != nil {
+			return err
+		}
+	}
+
+	root, err := loader.parse(file, module, imports, tokens)
+	if err != nil {
+		return err
+	}
+
+	loader.program.Children = append(loader.program.Children, root.Children...)
+	loader.done[module] = true
+
+	return nil
+}
+
+// find returns the file of a module in the first directory holding it
+func (loader *loader) find(module string) (string, error) {
+	for _, dir := range loader.dirs {
+		file := filepath.Clean(filepath.Join(dir, filepath.FromSlash(module)+Extension))
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+
+	return "", fmt.Errorf("Module '%v' not found in %v", module, strings.Join(loader.dirs, ", "))
+}
+
+// parse reports errors in a file with its name, since they only give line numbers
+func (loader *loader) parse(file string, module string, imports map[string]string, tokens tokenizer.TokenStack) (root *parser.ASTNode, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v: %v", file, r)
+		}
+	}()
+
+	return parser.ParseModule(&tokens, module, imports, loader.vars, loader.funcs), nil
+}
+
+// resolve checks an import path, returning it in the form declarations of the module are keyed by
+func (loader *loader) resolve(imported string) (string, error) {
+	module := path.Clean(imported)
+	if module == ".." || strings.HasPrefix(module, "../") || path.IsAbs(module) {
+		return "", fmt.Errorf("Import '%v' is outside the source directories", imported)
+	}
+
+	if module == parser.Prelude {
+		return "", fmt.Errorf("Module path '%v' is reserved for the standard library", module)
+	}
+
+	for _, part := range strings.Split(module, "/") {
+		if !pathPart.MatchString(part) {
+			return "", fmt.Errorf("Import '%v' is not a path of identifiers separated by '/'", imported)
+		}
+	}
+
+	return module, nil
+}
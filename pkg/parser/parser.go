@@ -2,7 +2,11 @@ package parser
 
 import (
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/GenM4/penguin/pkg/semantics"
 	"github.com/GenM4/penguin/pkg/tokenizer"
@@ -19,8 +23,21 @@ const (
 	Expression
 	Identifier
 	Term
+	Arm
+	Pattern
+	Index
+	Array
+	Field
+	Struct
+	Reference
+	Dereference
+	Extern
+	Asm
 )
 
+// AsmPlaceholder matches a {variable} reference inside an asm block
+var AsmPlaceholder = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)\}`)
+
 type ASTNode struct {
 	Kind       ASTNodeType
 	Data       string
@@ -41,11 +58,21 @@ func (nodeType ASTNodeType) String() string {
 		"Expression",
 		"Identifier",
 		"Term",
+		"Arm",
+		"Pattern",
+		"Index",
+		"Array",
+		"Field",
+		"Struct",
+		"Reference",
+		"Dereference",
+		"Extern",
+		"Asm",
 	}
 
 	i := int(nodeType)
 	switch {
-	case i <= int(Term):
+	case i <= int(Asm):
 		return name[i]
 	default:
 		return strconv.Itoa(i)
@@ -53,9 +80,127 @@ func (nodeType ASTNodeType) String() string {
 
 }
 
+// Prelude is the module of the standard library, whose public declarations every file can use unqualified
+const Prelude = "std"
+
 type ParserData struct {
-	vars  *semantics.VarMap
-	funcs *semantics.FuncMap
+	vars     *semantics.VarMap // globals
+	locals   semantics.VarMap  // parameters and locals of the function being parsed
+	funcs    *semantics.FuncMap
+	function string            // function being parsed, empty in global scope
+	module   string            // module of the file being parsed, empty for the program itself
+	imports  map[string]string // imported modules by the name they are referred to with
+}
+
+// qualify returns the key a global declared in this file is stored under.
+// Declarations of modules are prefixed with the module path, those of the program are not
+func (parserData *ParserData) qualify(name string) string {
+	if parserData.module == "" {
+		return name
+	}
+
+	return parserData.module + "." + name
+}
+
+// unqualify strips the module path from the key of a declaration of this file
+func (parserData *ParserData) unqualify(key string) string {
+	return strings.TrimPrefix(key, parserData.module+".")
+}
+
+// variable resolves name to a local of the function being parsed before looking for a global of this file
+func (parserData *ParserData) variable(name string) (*semantics.Variable, bool) {
+	if variable, ok := parserData.locals[name]; ok {
+		return variable, true
+	}
+
+	variable, ok := (*parserData.vars)[parserData.qualify(name)]
+	return variable, ok
+}
+
+// variableKey returns the key of the variable name resolves to, which identifiers in the AST refer to it by
+func (parserData *ParserData) variableKey(name string) string {
+	if _, ok := parserData.locals[name]; ok {
+		return name
+	}
+
+	return parserData.qualify(name)
+}
+
+// declared looks up a variable by the key an identifier in the AST refers to it by
+func (parserData *ParserData) declared(key string) (*semantics.Variable, bool) {
+	if variable, ok := parserData.locals[key]; ok {
+		return variable, true
+	}
+
+	variable, ok := (*parserData.vars)[key]
+	return variable, ok
+}
+
+// functionKey resolves an unqualified function name, returning an empty key when no visible function has it.
+// Functions of this file come first, then the public functions of the standard library, then builtins
+func (parserData *ParserData) functionKey(name string) string {
+	if _, ok := (*parserData.funcs)[parserData.qualify(name)]; ok {
+		return parserData.qualify(name)
+	}
+
+	if parserData.module != Prelude {
+		if function, ok := (*parserData.funcs)[Prelude+"."+name]; ok && function.Public {
+			return Prelude + "." + name
+		}
+	}
+
+	// functions of the program are not visible to the modules it imports
+	if function, ok := (*parserData.funcs)[name]; ok && (parserData.module == "" || function.Builtin) {
+		return name
+	}
+
+	return ""
+}
+
+// callee reports whether a call starts at the top of tokens, returning the number of tokens naming the function.
+// Functions of imported modules are called through the module name, as in geo.area(s)
+func (parserData *ParserData) callee(tokens *tokenizer.TokenStack) (int, bool) {
+	if tokens.Top().Kind != tokenizer.Identifier || tokens.Len() < 2 {
+		return 0, false
+	}
+
+	if _, ok := parserData.imports[tokens.Top().Data]; ok && tokens.Peek(1).Kind == tokenizer.Dot {
+		return 3, tokens.Len() > 3 && tokens.Peek(2).Kind == tokenizer.Identifier && tokens.Peek(3).Kind == tokenizer.Open_paren
+	}
+
+	return 1, tokens.Peek(1).Kind == tokenizer.Open_paren
+}
+
+// structAt resolves the struct type named at offset, returning the number of tokens naming it, or 0 if none does.
+// Structs of imported modules are named through the module name and must be public
+func (parserData *ParserData) structAt(tokens *tokenizer.TokenStack, offset int) (semantics.Type, int, error) {
+	name := tokens.Peek(offset).Data
+
+	if module, ok := parserData.imports[name]; ok && tokens.Len() > offset+2 && tokens.Peek(offset+1).Kind == tokenizer.Dot {
+		name = tokens.Peek(offset + 2).Data
+
+		typ, err := semantics.MatchType(module + "." + name)
+		if err != nil {
+			return -1, 0, fmt.Errorf("Type %v not declared in module '%v'", name, module)
+		} else if !typ.IsPublic() {
+			// still spans the tokens of a type, so the error is reported where a type is expected
+			return -1, 3, fmt.Errorf("Type %v is private to module '%v'", name, module)
+		}
+
+		return typ, 3, nil
+	}
+
+	if typ, err := semantics.MatchType(parserData.qualify(name)); err == nil {
+		return typ, 1, nil
+	}
+
+	if parserData.module != Prelude {
+		if typ, err := semantics.MatchType(Prelude + "." + name); err == nil && typ.IsPublic() {
+			return typ, 1, nil
+		}
+	}
+
+	return -1, 0, fmt.Errorf("Type %v not implemented", name)
 }
 
 func (node ASTNode) IsOperator() bool {
@@ -66,7 +211,13 @@ func (node ASTNode) IsOperator() bool {
 }
 
 func Parse(tokens *tokenizer.TokenStack, vars *semantics.VarMap, funcs *semantics.FuncMap) *ASTNode {
-	parserData := ParserData{vars: vars, funcs: funcs}
+	return ParseModule(tokens, "", nil, vars, funcs)
+}
+
+// ParseModule parses a file of a multi-file program, whose globals are stored under keys prefixed with module.
+// imports maps the names the file refers to imported modules by to their paths, which must be parsed already
+func ParseModule(tokens *tokenizer.TokenStack, module string, imports map[string]string, vars *semantics.VarMap, funcs *semantics.FuncMap) *ASTNode {
+	parserData := ParserData{vars: vars, funcs: funcs, module: module, imports: imports}
 
 	root, err := parseProgram(tokens, &parserData)
 	if err != nil {
@@ -76,14 +227,47 @@ func Parse(tokens *tokenizer.TokenStack, vars *semantics.VarMap, funcs *semantic
 	return root
 }
 
+// Imports returns the path tokens of the import statements of a file, in the order they are written
+func Imports(tokens *tokenizer.TokenStack) ([]tokenizer.Token, error) {
+	var paths []tokenizer.Token
+	scan := *tokens
+	depth := 0
+	for scan.Len() > 1 {
+		if scan.Top().Kind == tokenizer.Open_curl {
+			depth++
+		} else if scan.Top().Kind == tokenizer.Close_curl {
+			depth--
+		} else if depth == 0 && scan.Top().Kind == tokenizer.Import {
+			if scan.Peek(1).Kind != tokenizer.String_literal {
+				return nil, fmt.Errorf("Line %v: Expected module path after 'import', got '%v'", scan.Top().Line, scan.Peek(1).Data)
+			}
+
+			paths = append(paths, scan.Peek(1))
+		}
+
+		scan.Next()
+	}
+
+	return paths, nil
+}
+
 func parseProgram(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
 	var prog = ASTNode{
 		Kind: Program,
 	}
 
+	err := declareGlobals(tokens, parserData)
+	if err != nil {
+		return nil, err
+	}
+
 	for tokens.Len() > 1 {
 		if tokens.Top().Kind == tokenizer.CR {
 			tokens.Next()
+		} else if tokens.Top().Kind == tokenizer.Import {
+			// imported modules are loaded before the file is parsed
+			tokens.Next()
+			tokens.Next()
 		} else {
 
 			stmt, err := parseStatement(tokens, parserData)
@@ -103,8 +287,8 @@ func parseStatement(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNo
 		Kind: Statement,
 	}
 
-	if tokens.Top().Kind == tokenizer.Mutable && tokens.Peek(1).Kind == tokenizer.Type {
-		if tokens.Peek(3).Kind == tokenizer.SingleEqual {
+	if tokens.Top().Kind == tokenizer.Mutable && isTypeAt(tokens, 1, parserData) {
+		if tokens.Peek(typeLength(tokens, 1, parserData)+2).Kind == tokenizer.SingleEqual {
 			stmt, err := parseAssignment(true, false, tokens, parserData)
 			return *stmt, err
 		} else {
@@ -112,8 +296,8 @@ func parseStatement(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNo
 			tokens.Next()
 			return *stmt, err
 		}
-	} else if tokens.Top().Kind == tokenizer.Type {
-		if tokens.Peek(2).Kind == tokenizer.SingleEqual {
+	} else if isTypeAt(tokens, 0, parserData) {
+		if tokens.Peek(typeLength(tokens, 0, parserData)+1).Kind == tokenizer.SingleEqual {
 			stmt, err := parseAssignment(false, false, tokens, parserData)
 			return *stmt, err
 		} else {
@@ -121,17 +305,17 @@ func parseStatement(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNo
 			tokens.Next()
 			return *stmt, err
 		}
-	} else if _, ok := (*parserData.funcs)[tokens.Top().Data]; ok || tokens.Top().Kind == tokenizer.Std_Function {
+	} else if _, ok := parserData.callee(tokens); ok {
 		stmt, err := parseFunctionCall(tokens, parserData)
 		return *stmt, err
 	} else if tokens.Top().Kind == tokenizer.Identifier {
-		if tokens.Peek(1).Kind == tokenizer.SingleEqual {
+		if tokens.Peek(1).Kind == tokenizer.SingleEqual || tokens.Peek(1).Kind == tokenizer.Open_square || tokens.Peek(1).Kind == tokenizer.Dot {
 			stmt, err := parseAssignment(true, true, tokens, parserData)
 			return *stmt, err
 		} else if tokens.Peek(1).Kind == tokenizer.Operator_plusplus || tokens.Peek(1).Kind == tokenizer.Operator_minusminus {
 			stmt.Data = tokens.Peek(1).Data
 
-			expr, err := parseIncrement(tokens, parserData.vars)
+			expr, err := parseIncrement(tokens, parserData)
 			if err != nil {
 				return ASTNode{}, err
 			}
@@ -139,20 +323,61 @@ func parseStatement(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNo
 			stmt.Children = append(stmt.Children, expr)
 
 			return stmt, nil
-		} else if tokens.Peek(1).Kind == tokenizer.Open_paren {
-			tokens.Next()
-			stmt, err := parseFunctionCall(tokens, parserData)
-			return *stmt, err
 		} else {
 			return ASTNode{}, fmt.Errorf("Unrecognized operator after identifier '%v'", tokens.Top().Data)
 		}
+	} else if tokens.Top().Kind == tokenizer.Operator_star {
+		stmt, err := parseAssignment(true, true, tokens, parserData)
+		return *stmt, err
+	} else if tokens.Top().Kind == tokenizer.Struct {
+		stmt, err := parseStruct(tokens, parserData)
+		return *stmt, err
+	} else if tokens.Top().Kind == tokenizer.Extern {
+		stmt, err := parseExtern(tokens, parserData)
+		return *stmt, err
+	} else if tokens.Top().Kind == tokenizer.Export {
+		stmt, err := parseExport(tokens, parserData)
+		tokens.Next()
+		return *stmt, err
+	} else if tokens.Top().Kind == tokenizer.Pub {
+		stmt, err := parsePub(tokens, parserData)
+		return *stmt, err
+	} else if tokens.Top().Kind == tokenizer.Import {
+		return ASTNode{}, fmt.Errorf("Line %v: Imports are only allowed in global scope", tokens.Top().Line)
+	} else if tokens.Top().Kind == tokenizer.Match {
+		stmt, err := parseMatch(tokens, parserData)
+		return *stmt, err
+	} else if tokens.Top().Kind == tokenizer.Asm {
+		stmt.Data = tokens.Top().Data
+
+		block, err := parseAsm(tokens, parserData)
+		if err != nil {
+			return ASTNode{}, err
+		}
+
+		stmt.Children = append(stmt.Children, *block)
+
+		return stmt, nil
 	} else if tokens.Top().Kind == tokenizer.Return {
 		stmt.Data = tokens.Top().Data
+		line := tokens.Top().Line
+
+		returnType := semantics.Untyped
+		if function, ok := (*parserData.funcs)[parserData.function]; ok {
+			returnType = function.Type
+		}
 
 		tokens.Next()
 
-		if tokens.Top().Kind == tokenizer.Open_paren {
-			tokens.Next()
+		// a bare return is only allowed in void functions
+		if tokens.Top().Kind == tokenizer.CR || tokens.Top().Kind == tokenizer.Close_curl || tokens.Top().Kind == tokenizer.Comma {
+			if returnType != semantics.Void && returnType != semantics.Untyped {
+				return ASTNode{}, fmt.Errorf("Line %v: Missing return value in function '%v' returning %v", line, parserData.function, returnType.String())
+			}
+
+			return stmt, nil
+		} else if returnType == semantics.Void {
+			return ASTNode{}, fmt.Errorf("Line %v: Void function '%v' cannot return a value", line, parserData.function)
 		}
 
 		expr, err := parseExpression(tokens, 0, parserData)
@@ -160,7 +385,9 @@ func parseStatement(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNo
 			return ASTNode{}, err
 		}
 
-		tokens.Next()
+		if returnType != semantics.Untyped && !semantics.Assignable(returnType, expr.Type) {
+			return ASTNode{}, fmt.Errorf("Line %v: Returned expression (type: %v) does not match return type %v of '%v'", line, expr.Type.String(), returnType.String(), parserData.function)
+		}
 
 		stmt.Children = append(stmt.Children, *expr)
 
@@ -179,27 +406,60 @@ func parseAssignment(hasMutable bool, isDeclared bool, tokens *tokenizer.TokenSt
 	var err error
 	var lhs *ASTNode
 	if isDeclared {
-		lhs, err = parseTerm(tokens, parserData.vars)
-		if lhs.Mutable != true {
+		lhs, err = parseOperand(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if lhs.Kind != Identifier && lhs.Kind != Index && lhs.Kind != Field && lhs.Kind != Dereference {
+			return &ASTNode{}, fmt.Errorf("Cannot assign to %v '%v'", lhs.Kind.String(), lhs.Data)
+		} else if lhs.Kind == Dereference && lhs.Mutable != true {
+			return &ASTNode{}, fmt.Errorf("Attempt to write through '%v' (type: %v) to an immutable value", lhs.Children[0].Data, lhs.Children[0].Type.String())
+		} else if lhs.Mutable != true {
 			return &ASTNode{}, fmt.Errorf("Attempt to write to immutable value '%v'", lhs.Data)
 		}
 	} else {
 		lhs, err = parseDeclaration(hasMutable, tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		tokens.Next()
+	}
+
+	if tokens.Top().Kind != tokenizer.SingleEqual {
+		return &ASTNode{}, fmt.Errorf("Expected '=' after '%v', got '%v'", lhs.Data, tokens.Top().Data)
 	}
 
-	tokens.Next()
 	tokens.Next()
 
-	expr, err := parseExpression(tokens, 0, parserData)
+	var expr *ASTNode
+	if variable, _ := parserData.declared(lhs.Data); lhs.Kind == Declaration && variable.IsArray() {
+		expr, err = parseArrayLiteral(variable, tokens, parserData)
+	} else {
+		expr, err = parseExpression(tokens, 0, parserData)
+	}
 	if err != nil {
 		return &ASTNode{}, err
 	}
 
-	if lhs.Type != expr.Type {
+	if !semantics.Assignable(lhs.Type, expr.Type) {
 		return &ASTNode{}, fmt.Errorf("Attempted to assign expression (type: %v) to '%v' (type: %v)", expr.Type.String(), lhs.Data, lhs.Type.String())
 	}
 
-	tokens.Next()
+	// const bindings of integral values known at compile time are inlined wherever they are read
+	if variable, _ := parserData.declared(lhs.Data); !isDeclared && !lhs.Mutable && !variable.IsArray() && (lhs.Type == semantics.Int || lhs.Type == semantics.Char) {
+		value, ok, err := constValue(expr, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if ok {
+			variable.Constant = true
+			variable.Value = value
+			expr = constTerm(lhs.Type, value)
+		}
+	}
 
 	assignment.Children = append(assignment.Children, *lhs)
 	assignment.Children = append(assignment.Children, *expr)
@@ -225,21 +485,74 @@ func parseDeclaration(hasMutable bool, tokens *tokenizer.TokenStack, parserData
 	}
 
 	var err error
-	decl.Type, err = semantics.MatchType(tokens.Top().Data)
+	decl.Type, err = parseType(tokens, parserData)
 	if err != nil {
 		return &ASTNode{}, err
 	}
 
 	tokens.Next()
 
-	decl.Data = tokens.Top().Data
+	length := 0
+	if tokens.Top().Kind == tokenizer.Open_square {
+		length, err = parseArrayLength(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		tokens.Next()
+	}
+
+	// globals and functions are stored under the key of this file
+	name := tokens.Top().Data
+	decl.Data = name
+	if parserData.function == "" {
+		decl.Data = parserData.qualify(name)
+	}
+
+	if decl.Type == semantics.Void && tokens.Peek(1).Kind != tokenizer.Open_paren {
+		return &ASTNode{}, fmt.Errorf("Variable '%v' cannot have type %v", decl.Data, decl.Type.String())
+	}
+
+	if length != 0 && decl.Type.IsStruct() {
+		return &ASTNode{}, fmt.Errorf("Array '%v' of struct type %v not supported", decl.Data, decl.Type.String())
+	}
 
 	if tokens.Peek(1).Kind != tokenizer.Open_paren {
-		(*parserData.vars)[decl.Data] = &semantics.Variable{Mutable: decl.Mutable, Type: decl.Type, StackLocation: 0}
+		if length < 0 && tokens.Peek(1).Kind != tokenizer.SingleEqual {
+			return &ASTNode{}, fmt.Errorf("Array '%v' declared without a length or initializer", decl.Data)
+		}
+
+		// identifiers of the entry program refer to globals by their plain name, so locals cannot shadow them
+		if _, ok := (*parserData.vars)[parserData.qualify(name)]; ok {
+			return &ASTNode{}, fmt.Errorf("Variable '%v' already declared in global scope", name)
+		}
+
+		// a function has one scope, match arms included, so each local and parameter has one type
+		if _, ok := parserData.locals[name]; ok && parserData.function != "" {
+			return &ASTNode{}, fmt.Errorf("Variable '%v' already declared in function '%v'", name, parserData.function)
+		}
+
+		variable := &semantics.Variable{Mutable: decl.Mutable, Type: decl.Type, StackLocation: 0, Length: length, IsGlobal: parserData.function == ""}
+		if variable.IsGlobal {
+			(*parserData.vars)[decl.Data] = variable
+		} else {
+			parserData.locals[decl.Data] = variable
+		}
+	} else if length != 0 {
+		return &ASTNode{}, fmt.Errorf("Function '%v' cannot return an array", decl.Data)
+	} else if parserData.function != "" {
+		return &ASTNode{}, fmt.Errorf("Function '%v' declared inside function '%v'", decl.Data, parserData.function)
 	} else {
 		tokens.Next()
 		tokens.Next()
 
+		parserData.function = decl.Data
+		parserData.locals = make(semantics.VarMap)
+		defer func() {
+			parserData.function = ""
+			parserData.locals = nil
+		}()
+
 		args, err := parseArgs(tokens, parserData)
 		if err != nil {
 			return &ASTNode{}, err
@@ -261,217 +574,1400 @@ func parseDeclaration(hasMutable bool, tokens *tokenizer.TokenStack, parserData
 		scope.Parent = decl
 		decl.Children = append(decl.Children, scope)
 
-		(*parserData.funcs)[decl.Data] = &semantics.Function{Mutable: decl.Mutable, Type: decl.Type, Signature: "_" + decl.Data, NumArgs: len(args)}
+		params := make([]semantics.Param, len(args))
+		for i, arg := range args {
+			params[i] = semantics.Param{Name: arg.Data, Type: arg.Type, Mutable: arg.Mutable}
+		}
+
+		(*parserData.funcs)[decl.Data] = &semantics.Function{Mutable: decl.Mutable, Type: decl.Type, Signature: "_" + semantics.Symbol(decl.Data), Params: params, Vars: parserData.locals}
 
 	}
 
 	return decl, nil
 }
 
-func parseArgs(tokens *tokenizer.TokenStack, parserData *ParserData) ([]ASTNode, error) {
-	var args []ASTNode
-	for tokens.Top().Kind != tokenizer.Close_paren {
-		ident, err := parseDeclaration(tokens.Top().Kind == tokenizer.Mutable, tokens, parserData)
+func declareGlobals(tokens *tokenizer.TokenStack, parserData *ParserData) error {
+	// registers every struct and function declared in global scope before any body is parsed,
+	// so they can be referred to above their declaration
+	var structs []tokenizer.TokenStack
+	scan := *tokens
+	depth := 0
+	for scan.Len() > 2 {
+		if scan.Top().Kind == tokenizer.Open_curl {
+			depth++
+		} else if scan.Top().Kind == tokenizer.Close_curl {
+			depth--
+		} else if depth == 0 && scan.Top().Kind == tokenizer.Struct {
+			_, err := semantics.DeclareStruct(parserData.qualify(scan.Peek(1).Data))
+			if err != nil {
+				return err
+			}
 
-		if err != nil {
-			return []ASTNode{}, err
+			structs = append(structs, scan)
 		}
 
-		args = append(args, *ident)
-
-		tokens.Next()
-
-		if tokens.Top().Kind == tokenizer.Comma {
-			tokens.Next()
-		}
+		scan.Next()
 	}
 
-	return args, nil
-}
+	// structs are laid out once every struct they contain by value has been
+	for len(structs) > 0 {
+		var pending []tokenizer.TokenStack
+		var err error
+		for _, decl := range structs {
+			_, err = parseStruct(&decl, parserData)
+			if err != nil {
+				pending = append(pending, decl)
+			}
+		}
 
-func parseScope(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNode, error) {
-	var scope = &ASTNode{
-		Kind: Scope,
+		if len(pending) == len(structs) {
+			return err
+		}
+		structs = pending
 	}
 
-	for tokens.Top().Kind != tokenizer.Close_curl {
-		if tokens.Top().Kind == tokenizer.CR {
-			tokens.Next()
-		} else {
-
-			stmt, err := parseStatement(tokens, parserData)
+	scan = *tokens
+	depth = 0
+	start := true
+	for scan.Len() > 1 {
+		tok := scan.Top()
+		if depth == 0 && start {
+			err := declareFunction(scan, parserData)
 			if err != nil {
-				return ASTNode{}, err
+				return err
 			}
+		}
 
-			scope.Children = append(scope.Children, stmt)
+		if tok.Kind == tokenizer.Open_curl {
+			depth++
+		} else if tok.Kind == tokenizer.Close_curl {
+			depth--
 		}
+		start = tok.Kind == tokenizer.CR
+
+		scan.Next()
 	}
 
-	return *scope, nil
+	return nil
 }
 
-func parseIncrement(tokens *tokenizer.TokenStack, vars *semantics.VarMap) (ASTNode, error) {
-	lhs, err := parseTerm(tokens, vars)
-	if err != nil {
-		return ASTNode{}, err
+func declareFunction(scan tokenizer.TokenStack, parserData *ParserData) error {
+	if scan.Top().Kind == tokenizer.Pub {
+		scan.Next()
 	}
 
-	if lhs.Type != semantics.Int {
-		return ASTNode{}, fmt.Errorf("Increment/Decrement operator not implemented for type %v", lhs.Type.String())
+	extern := scan.Top().Kind == tokenizer.Extern
+	exported := scan.Top().Kind == tokenizer.Export
+	if extern || exported {
+		scan.Next()
 	}
 
-	rhs := &ASTNode{
-		Kind: Term,
-		Data: "1",
-		Type: semantics.Int,
+	mutable := false
+	if scan.Top().Kind == tokenizer.Mutable {
+		mutable = scan.Top().Data == "mut"
+		scan.Next()
 	}
 
-	tokens.Next()
+	if !isTypeAt(&scan, 0, parserData) {
+		return nil
+	}
 
-	expr := &ASTNode{
-		Kind:       Expression,
-		Precedence: 2,
-		Data:       string(tokens.Top().Data[1]),
+	typ, err := parseType(&scan, parserData)
+	if err != nil {
+		return err
 	}
 
-	expr.Children = append(expr.Children, *lhs)
-	expr.Children = append(expr.Children, *rhs)
+	if scan.Peek(1).Kind != tokenizer.Identifier || scan.Peek(2).Kind != tokenizer.Open_paren {
+		return nil
+	}
 
-	tokens.Next()
+	name := scan.Next().Data
+	key := parserData.qualify(name)
+	if _, ok := (*parserData.funcs)[key]; ok {
+		return fmt.Errorf("Function '%v' already declared", name)
+	}
 
-	return *expr, nil
-}
+	scan.Next()
+	scan.Next()
 
-func parseFunctionCall(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
-	stmt := &ASTNode{
-		Data: tokens.Top().Data,
-		Kind: Call,
+	// malformed parameter lists are left to be reported when the declaration is parsed
+	params, variadic, err := parseParams(&scan, parserData)
+	if err != nil {
+		return nil
 	}
 
-	tokens.Next()
-
-	if tokens.Top().Kind == tokenizer.Open_paren {
-		tokens.Next()
-	} else {
-		return &ASTNode{}, fmt.Errorf("Expected '(' before '%v'", tokens.Top().Data)
+	signature := "_" + semantics.Symbol(key)
+	if extern || exported {
+		signature = name
 	}
 
-	args := []ASTNode{}
+	(*parserData.funcs)[key] = &semantics.Function{Mutable: mutable, Type: typ, Signature: signature, Params: params, Variadic: variadic, Extern: extern, Exported: exported}
+
+	return nil
+}
+
+func parseParams(tokens *tokenizer.TokenStack, parserData *ParserData) ([]semantics.Param, bool, error) {
+	// expects the token after '(' on top, leaves ')' on top, reporting whether the list ends in '...'
+	var params []semantics.Param
 	for tokens.Top().Kind != tokenizer.Close_paren {
-		expr, err := parseExpression(tokens, 0, parserData)
+		// '...' is read as '..' followed by '.'
+		if tokens.Top().Kind == tokenizer.Range && tokens.Peek(1).Kind == tokenizer.Dot {
+			tokens.Next()
+			if tokens.Next().Kind != tokenizer.Close_paren {
+				return nil, false, fmt.Errorf("Expected ')' after '...', got '%v'", tokens.Top().Data)
+			}
+
+			return params, true, nil
+		}
+
+		param := semantics.Param{}
+		if tokens.Top().Kind == tokenizer.Mutable {
+			param.Mutable = tokens.Top().Data == "mut"
+			tokens.Next()
+		}
+
+		var err error
+		param.Type, err = parseType(tokens, parserData)
 		if err != nil {
-			return &ASTNode{}, err
+			return nil, false, err
 		}
-		args = append(args, *expr)
 
-		if tokens.Top().Kind == tokenizer.Comma {
+		if tokens.Next().Kind != tokenizer.Identifier {
+			return nil, false, fmt.Errorf("Expected parameter name after type %v, got '%v'", param.Type.String(), tokens.Top().Data)
+		}
+		param.Name = tokens.Top().Data
+
+		params = append(params, param)
+
+		if tokens.Next().Kind == tokenizer.Comma {
 			tokens.Next()
+		} else if tokens.Top().Kind != tokenizer.Close_paren {
+			return nil, false, fmt.Errorf("Expected ',' or ')' after parameter '%v', got '%v'", param.Name, tokens.Top().Data)
 		}
 	}
 
-	if (*parserData.funcs)[stmt.Data].NumArgs != len(args) {
-		return &ASTNode{}, fmt.Errorf("Call to function '%v' with incorrect number of arguments. Expected %v args, got %v", stmt.Data, (*parserData.funcs)[stmt.Data].NumArgs, len(args))
-	}
+	return params, false, nil
+}
 
-	if tokens.Top().Kind == tokenizer.Close_paren {
-		tokens.Next()
-	} else {
-		return &ASTNode{}, fmt.Errorf("Mismatched parentheses, expected ')' before '%v'", tokens.Top().Data)
+func parseExport(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	// leaves the closing '}' of the function on top
+	line := tokens.Top().Line
+
+	tokens.Next()
+
+	hasMutable := tokens.Top().Kind == tokenizer.Mutable
+	offset := 0
+	if hasMutable {
+		offset = 1
 	}
 
-	stmt.Children = append(stmt.Children, args...)
+	if !isTypeAt(tokens, offset, parserData) || tokens.Peek(offset+typeLength(tokens, offset, parserData)+1).Kind != tokenizer.Open_paren {
+		return &ASTNode{}, fmt.Errorf("Line %v: Only functions can be exported", line)
+	}
 
-	return stmt, nil
+	decl, err := parseDeclaration(hasMutable, tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
 
-}
+	function := (*parserData.funcs)[decl.Data]
 
-func parseExpression(tokens *tokenizer.TokenStack, minPrec int, parserData *ParserData) (*ASTNode, error) {
-	if function, ok := (*parserData.funcs)[tokens.Top().Data]; ok || tokens.Top().Kind == tokenizer.Std_Function {
-		expr, err := parseFunctionCall(tokens, parserData)
-		expr.Type = function.Type
-		expr.Mutable = function.Mutable
-		return expr, err
-	} else {
-		lhs, err := parseTerm(tokens, parserData.vars)
-		if err != nil {
-			return &ASTNode{}, err
+	// structs are passed by address between penguin functions, which C does not expect
+	if function.Type.IsStruct() {
+		return &ASTNode{}, fmt.Errorf("Line %v: Exported function '%v' cannot return struct type %v", line, decl.Data, function.Type.String())
+	}
+	for _, param := range function.Params {
+		if param.Type.IsStruct() {
+			return &ASTNode{}, fmt.Errorf("Line %v: Exported function '%v' cannot take struct parameter '%v'", line, decl.Data, param.Name)
 		}
-		lookahead := tokens.Peek(1)
+	}
 
-		var expr *ASTNode
-		var nextMinPrec int
+	function.Exported = true
+	function.Signature = parserData.unqualify(decl.Data)
 
-		for tokenizer.IsOperator(lookahead) && tokenizer.OperatorPrecedence(lookahead) >= minPrec {
-			tokens.Next()
-			nextMinPrec = tokenizer.OperatorPrecedence(tokens.Top())
+	return decl, nil
+}
 
-			expr = new(ASTNode)
-			expr.Kind = Expression
-			expr.Data = tokens.Top().Data
-			expr.Precedence = tokenizer.OperatorPrecedence(tokens.Top()) + 1
-			expr.Children = []ASTNode{{}, {}}
+func parsePub(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	// functions and structs declared 'pub' can be used by the files importing this one
+	line := tokens.Top().Line
 
-			tokens.Next()
+	if parserData.function != "" {
+		return &ASTNode{}, fmt.Errorf("Line %v: 'pub' is only allowed in global scope", line)
+	}
 
-			rhs, err := parseTerm(tokens, parserData.vars)
-			if err != nil {
-				return &ASTNode{}, err
-			}
+	tokens.Next()
 
-			lookahead = tokens.Peek(1)
-			for tokenizer.IsOperator(lookahead) && tokenizer.OperatorPrecedence(lookahead) > nextMinPrec {
-				rhs, err = parseExpression(tokens, nextMinPrec, parserData)
+	stmt, err := parseStatement(tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	if function, ok := (*parserData.funcs)[stmt.Data]; ok && (stmt.Kind == Extern || (stmt.Kind == Declaration && len(stmt.Children) > 0)) {
+		function.Public = true
+	} else if stmt.Kind == Struct {
+		semantics.MakePublic(stmt.Type)
+	} else {
+		return &ASTNode{}, fmt.Errorf("Line %v: Only functions and structs can be declared 'pub'", line)
+	}
+
+	return &stmt, nil
+}
+
+func parseAsm(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	// leaves the token after the block on top
+	line := tokens.Top().Line
+
+	if tokens.Next().Kind != tokenizer.Asm_body {
+		return &ASTNode{}, fmt.Errorf("Line %v: Expected '{' after 'asm'", line)
+	}
+
+	block := &ASTNode{
+		Kind: Asm,
+		Data: tokens.Top().Data,
+	}
+
+	// placeholders are replaced with the address of the variable they name
+	for _, match := range AsmPlaceholder.FindAllStringSubmatch(block.Data, -1) {
+		variable, ok := parserData.variable(match[1])
+		if !ok {
+			return &ASTNode{}, fmt.Errorf("Line %v: Undefined variable '%v' in asm block", line, match[1])
+		}
+
+		block.Children = append(block.Children, ASTNode{Kind: Identifier, Data: parserData.variableKey(match[1]), Type: variable.Type, Mutable: variable.Mutable})
+	}
+
+	tokens.Next()
+
+	return block, nil
+}
+
+func parseExtern(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	// leaves the token after ')' on top
+	decl := &ASTNode{
+		Kind: Extern,
+	}
+	line := tokens.Top().Line
+
+	if parserData.function != "" {
+		return &ASTNode{}, fmt.Errorf("Line %v: Extern declarations are only allowed in global scope", line)
+	}
+
+	tokens.Next()
+
+	var err error
+	decl.Type, err = parseType(tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	decl.Data = tokens.Next().Data
+	if tokens.Top().Kind != tokenizer.Identifier || tokens.Next().Kind != tokenizer.Open_paren {
+		return &ASTNode{}, fmt.Errorf("Line %v: Expected function name and '(' after 'extern %v'", line, decl.Type.String())
+	}
+
+	tokens.Next()
+
+	params, variadic, err := parseParams(tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, fmt.Errorf("Line %v: %v", line, err)
+	}
+
+	tokens.Next()
+
+	// structs are passed by address between penguin functions, which C does not expect
+	if decl.Type.IsStruct() {
+		return &ASTNode{}, fmt.Errorf("Line %v: Extern function '%v' cannot return struct type %v", line, decl.Data, decl.Type.String())
+	}
+	for _, param := range params {
+		if param.Type.IsStruct() {
+			return &ASTNode{}, fmt.Errorf("Line %v: Extern function '%v' cannot take struct parameter '%v'", line, decl.Data, param.Name)
+		}
+	}
+
+	// C functions keep their name, but are declared in the namespace of the file
+	key := parserData.qualify(decl.Data)
+	if existing, ok := (*parserData.funcs)[key]; ok && !existing.Extern {
+		return &ASTNode{}, fmt.Errorf("Line %v: Function '%v' already declared", line, decl.Data)
+	}
+
+	(*parserData.funcs)[key] = &semantics.Function{Type: decl.Type, Signature: decl.Data, Params: params, Variadic: variadic, Extern: true}
+	decl.Data = key
+
+	return decl, nil
+}
+
+func parseArgs(tokens *tokenizer.TokenStack, parserData *ParserData) ([]ASTNode, error) {
+	var args []ASTNode
+	for tokens.Top().Kind != tokenizer.Close_paren {
+		ident, err := parseDeclaration(tokens.Top().Kind == tokenizer.Mutable, tokens, parserData)
+
+		if err != nil {
+			return []ASTNode{}, err
+		}
+
+		if variable, _ := parserData.declared(ident.Data); variable.IsArray() {
+			return []ASTNode{}, fmt.Errorf("Array parameter '%v' not supported", ident.Data)
+		}
+
+		args = append(args, *ident)
+
+		tokens.Next()
+
+		if tokens.Top().Kind == tokenizer.Comma {
+			tokens.Next()
+		}
+	}
+
+	return args, nil
+}
+
+func parseScope(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNode, error) {
+	var scope = &ASTNode{
+		Kind: Scope,
+	}
+
+	for tokens.Top().Kind != tokenizer.Close_curl {
+		if tokens.Top().Kind == tokenizer.CR {
+			tokens.Next()
+		} else {
+
+			stmt, err := parseStatement(tokens, parserData)
+			if err != nil {
+				return ASTNode{}, err
+			}
+
+			scope.Children = append(scope.Children, stmt)
+		}
+	}
+
+	return *scope, nil
+}
+
+func parseMatch(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	match := &ASTNode{
+		Data: tokens.Top().Data,
+		Kind: Statement,
+	}
+
+	tokens.Next()
+
+	subject, err := parseExpression(tokens, 0, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	if subject.Type != semantics.Int && subject.Type != semantics.Char {
+		return &ASTNode{}, fmt.Errorf("Match not implemented for type %v", subject.Type.String())
+	}
+
+	match.Type = subject.Type
+	match.Children = append(match.Children, *subject)
+
+	if tokens.Top().Kind != tokenizer.Open_curl {
+		return &ASTNode{}, fmt.Errorf("Expected '{' after match subject, got '%v'", tokens.Top().Data)
+	}
+
+	tokens.Next()
+
+	hasDefault := false
+	for tokens.Top().Kind != tokenizer.Close_curl {
+		if tokens.Top().Kind == tokenizer.CR || tokens.Top().Kind == tokenizer.Comma {
+			tokens.Next()
+			continue
+		}
+
+		if hasDefault {
+			return &ASTNode{}, fmt.Errorf("Unreachable match arm '%v' after '_'", tokens.Top().Data)
+		}
+
+		arm, err := parseArm(match, tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		hasDefault = arm.Children[0].Data == "_"
+		match.Children = append(match.Children, *arm)
+	}
+
+	tokens.Next()
+
+	if len(match.Children) == 1 {
+		return &ASTNode{}, fmt.Errorf("Match on '%v' has no arms", subject.Data)
+	}
+
+	if !hasDefault {
+		err = checkExhaustive(match)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+	}
+
+	return match, nil
+}
+
+func parseArm(match *ASTNode, tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	arm := &ASTNode{
+		Kind: Arm,
+	}
+
+	pattern, err := parsePattern(match.Type, tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+	arm.Children = append(arm.Children, *pattern)
+
+	if tokens.Top().Kind != tokenizer.Arrow {
+		return &ASTNode{}, fmt.Errorf("Expected '=>' after match pattern '%v', got '%v'", pattern.Data, tokens.Top().Data)
+	}
+
+	tokens.Next()
+
+	var body ASTNode
+	if tokens.Top().Kind == tokenizer.Open_curl {
+		tokens.Next()
+
+		body, err = parseScope(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		tokens.Next()
+	} else {
+		stmt, err := parseStatement(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		body = ASTNode{
+			Kind:     Scope,
+			Children: []ASTNode{stmt},
+		}
+	}
+	body.Parent = match
+	arm.Children = append(arm.Children, body)
+
+	return arm, nil
+}
+
+func parsePattern(typ semantics.Type, tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	pattern := &ASTNode{
+		Data: tokens.Top().Data,
+		Kind: Pattern,
+		Type: typ,
+	}
+
+	if tokens.Top().Kind == tokenizer.Wildcard {
+		tokens.Next()
+		return pattern, nil
+	}
+
+	for {
+		if tokens.Top().Kind != tokenizer.Int_literal && tokens.Top().Kind != tokenizer.Char_literal {
+			return &ASTNode{}, fmt.Errorf("Match patterns must be literals, got '%v'", tokens.Top().Data)
+		}
+
+		term, err := parseTerm(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if term.Type != typ {
+			return &ASTNode{}, fmt.Errorf("Match pattern %v (type: %v) does not match subject type %v", term.Data, term.Type.String(), typ.String())
+		}
+
+		pattern.Children = append(pattern.Children, *term)
+
+		tokens.Next()
+
+		if tokens.Top().Kind != tokenizer.Range || len(pattern.Children) == 2 {
+			break
+		}
+
+		tokens.Next()
+	}
+
+	if len(pattern.Children) == 2 {
+		pattern.Data = pattern.Children[0].Data + ".." + pattern.Children[1].Data
+
+		lo, hi, err := PatternBounds(*pattern)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if lo > hi {
+			return &ASTNode{}, fmt.Errorf("Empty range pattern %v", pattern.Data)
+		}
+	}
+
+	return pattern, nil
+}
+
+// PatternBounds returns the inclusive range of values matched by a literal or range pattern
+func PatternBounds(pattern ASTNode) (int, int, error) {
+	if len(pattern.Children) == 0 {
+		return pattern.Type.Bounds()
+	}
+
+	lo, err := semantics.LiteralValue(pattern.Children[0].Data, pattern.Type)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	hi := lo
+	if len(pattern.Children) == 2 {
+		hi, err = semantics.LiteralValue(pattern.Children[1].Data, pattern.Type)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return lo, hi, nil
+}
+
+func checkExhaustive(match *ASTNode) error {
+	type interval struct{ lo, hi int }
+
+	var covered []interval
+	for _, arm := range match.Children[1:] {
+		lo, hi, err := PatternBounds(arm.Children[0])
+		if err != nil {
+			return err
+		}
+		covered = append(covered, interval{lo, hi})
+	}
+
+	sort.Slice(covered, func(i, j int) bool { return covered[i].lo < covered[j].lo })
+
+	min, max, err := match.Type.Bounds()
+	if err != nil {
+		return err
+	}
+
+	next := min
+	for _, iv := range covered {
+		if iv.lo > next {
+			break
+		}
+		if iv.hi >= next {
+			if iv.hi == max {
+				return nil
+			}
+			next = iv.hi + 1
+		}
+	}
+
+	return fmt.Errorf("Non-exhaustive match on '%v': value %v not covered, add a '_' arm", match.Children[0].Data, next)
+}
+
+func parseIncrement(tokens *tokenizer.TokenStack, parserData *ParserData) (ASTNode, error) {
+	lhs, err := parseTerm(tokens, parserData)
+	if err != nil {
+		return ASTNode{}, err
+	}
+
+	if lhs.Type != semantics.Int {
+		return ASTNode{}, fmt.Errorf("Increment/Decrement operator not implemented for type %v", lhs.Type.String())
+	}
+
+	rhs := &ASTNode{
+		Kind: Term,
+		Data: "1",
+		Type: semantics.Int,
+	}
+
+	tokens.Next()
+
+	expr := &ASTNode{
+		Kind:       Expression,
+		Precedence: 2,
+		Data:       string(tokens.Top().Data[1]),
+	}
+
+	expr.Children = append(expr.Children, *lhs)
+	expr.Children = append(expr.Children, *rhs)
+
+	tokens.Next()
+
+	return *expr, nil
+}
+
+func parseFunctionCall(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	stmt := &ASTNode{
+		Kind: Call,
+	}
+	line := tokens.Top().Line
+	name := tokens.Top().Data
+
+	var function *semantics.Function
+	var ok bool
+	if length, _ := parserData.callee(tokens); length == 3 {
+		module := parserData.imports[name]
+		name = tokens.Peek(2).Data
+		stmt.Data = module + "." + name
+
+		function, ok = (*parserData.funcs)[stmt.Data]
+		if !ok {
+			return &ASTNode{}, fmt.Errorf("Line %v: Undefined function '%v' in module '%v'", line, name, module)
+		} else if !function.Public {
+			return &ASTNode{}, fmt.Errorf("Line %v: Function '%v' is private to module '%v'", line, name, module)
+		}
+
+		tokens.Next()
+		tokens.Next()
+	} else {
+		stmt.Data = parserData.functionKey(name)
+
+		function, ok = (*parserData.funcs)[stmt.Data]
+		if !ok {
+			return &ASTNode{}, fmt.Errorf("Line %v: Undefined function '%v'", line, name)
+		}
+	}
+
+	tokens.Next()
+
+	if tokens.Top().Kind == tokenizer.Open_paren {
+		tokens.Next()
+	} else {
+		return &ASTNode{}, fmt.Errorf("Expected '(' before '%v'", tokens.Top().Data)
+	}
+
+	args := []ASTNode{}
+	for tokens.Top().Kind != tokenizer.Close_paren {
+		expr, err := parseExpression(tokens, 0, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+		args = append(args, *expr)
+
+		if tokens.Top().Kind == tokenizer.Comma {
+			tokens.Next()
+		} else if tokens.Top().Kind != tokenizer.Close_paren {
+			return &ASTNode{}, fmt.Errorf("Expected ',' or ')' in call to '%v', got '%v'", stmt.Data, tokens.Top().Data)
+		}
+	}
+
+	if function.Variadic {
+		if function.MaxArgs > 0 && (len(args) < len(function.Params) || len(args) > function.MaxArgs) {
+			return &ASTNode{}, fmt.Errorf("Line %v: Call to function '%v' with incorrect number of arguments. Expected %v to %v args, got %v", line, stmt.Data, len(function.Params), function.MaxArgs, len(args))
+		} else if len(args) < len(function.Params) {
+			return &ASTNode{}, fmt.Errorf("Line %v: Call to function '%v' with incorrect number of arguments. Expected at least %v args, got %v", line, stmt.Data, len(function.Params), len(args))
+		}
+
+		// arguments past the declared parameters are passed as whole registers
+		for i := len(function.Params); i < len(args); i++ {
+			if args[i].Type.IsStruct() || args[i].Type == semantics.Void {
+				return &ASTNode{}, fmt.Errorf("Line %v: Argument %v in call to '%v' has type %v, expected a scalar", line, i+1, stmt.Data, args[i].Type.String())
+			}
+		}
+	} else if len(function.Params) != len(args) {
+		return &ASTNode{}, fmt.Errorf("Line %v: Call to function '%v' with incorrect number of arguments. Expected %v args, got %v", line, stmt.Data, len(function.Params), len(args))
+	}
+
+	for i, param := range function.Params {
+		if !semantics.Assignable(param.Type, args[i].Type) {
+			return &ASTNode{}, fmt.Errorf("Line %v: Argument %v in call to '%v' has type %v, expected %v", line, i+1, stmt.Data, args[i].Type.String(), param.Type.String())
+		}
+	}
+
+	if tokens.Top().Kind == tokenizer.Close_paren {
+		tokens.Next()
+	} else {
+		return &ASTNode{}, fmt.Errorf("Mismatched parentheses, expected ')' before '%v'", tokens.Top().Data)
+	}
+
+	stmt.Children = append(stmt.Children, args...)
+
+	return stmt, nil
+
+}
+
+func parseExpression(tokens *tokenizer.TokenStack, minPrec int, parserData *ParserData) (*ASTNode, error) {
+	// precedence climbing, leaves the token following the expression on top
+	lhs, err := parseOperand(tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	for tokenizer.IsOperator(tokens.Top()) && tokenizer.OperatorPrecedence(tokens.Top()) >= minPrec {
+		prec := tokenizer.OperatorPrecedence(tokens.Top())
+
+		if lhs.Type.IsStruct() {
+			return &ASTNode{}, fmt.Errorf("Operator '%v' not defined for type %v", tokens.Top().Data, lhs.Type.String())
+		}
+
+		expr := &ASTNode{
+			Kind:       Expression,
+			Data:       tokens.Top().Data,
+			Precedence: prec + 1,
+			Type:       lhs.Type,
+		}
+
+		tokens.Next()
+
+		rhs, err := parseExpression(tokens, prec+1, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if rhs.Type.IsStruct() {
+			return &ASTNode{}, fmt.Errorf("Operator '%v' not defined for type %v", expr.Data, rhs.Type.String())
+		}
+
+		err = checkPointerArithmetic(expr.Data, lhs.Type, rhs.Type)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		expr.Children = []ASTNode{*lhs, *rhs}
+
+		lhs = expr
+
+		value, ok, err := constValue(lhs, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		} else if ok {
+			lhs = constTerm(lhs.Type, value)
+		}
+	}
+
+	return lhs, nil
+}
+
+func parseOperand(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	// names followed by '(' are calls, so variables can share a name with a function
+	if _, ok := parserData.callee(tokens); ok {
+		expr, err := parseFunctionCall(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		function := (*parserData.funcs)[expr.Data]
+
+		if function.Type == semantics.Void {
+			return &ASTNode{}, fmt.Errorf("Void function '%v' used as a value", expr.Data)
+		}
+
+		expr.Type = function.Type
+		expr.Mutable = function.Mutable
+
+		value, ok, err := constValue(expr, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		} else if ok {
+			return constTerm(expr.Type, value), nil
+		}
+
+		for tokens.Top().Kind == tokenizer.Dot {
+			expr, err = parseField(expr, tokens)
+			if err != nil {
+				return &ASTNode{}, err
+			}
+
+			tokens.Next()
+		}
+
+		return expr, nil
+	} else if typ, length, err := parserData.structAt(tokens, 0); err == nil && tokens.Peek(length).Kind == tokenizer.Open_curl {
+		for i := 1; i < length; i++ {
+			tokens.Next()
+		}
+
+		return parseStructLiteral(typ, tokens, parserData)
+	} else if tokens.Top().Kind == tokenizer.Operator_star {
+		tokens.Next()
+
+		pointer, err := parseOperand(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		return dereference(pointer)
+	} else if tokens.Top().Kind == tokenizer.Ampersand {
+		tokens.Next()
+
+		operand, err := parseOperand(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if operand.Kind != Identifier && operand.Kind != Index && operand.Kind != Field && operand.Kind != Dereference {
+			return &ASTNode{}, fmt.Errorf("Cannot take the address of %v '%v'", operand.Kind.String(), operand.Data)
+		}
+
+		return &ASTNode{
+			Kind:     Reference,
+			Data:     "&",
+			Type:     semantics.PointerTo(operand.Type, operand.Mutable),
+			Children: []ASTNode{*operand},
+		}, nil
+	} else if tokens.Top().Kind == tokenizer.Open_paren {
+		tokens.Next()
+
+		expr, err := parseExpression(tokens, 0, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if tokens.Top().Kind != tokenizer.Close_paren {
+			return &ASTNode{}, fmt.Errorf("Mismatched parentheses, expected ')' before '%v'", tokens.Top().Data)
+		}
+
+		tokens.Next()
+
+		return expr, nil
+	}
+
+	term, err := parseTerm(tokens, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	tokens.Next()
+
+	return term, nil
+}
+
+func parseTerm(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	if tokens.Top().Kind == tokenizer.Int_literal {
+		return &ASTNode{
+			Kind: Term,
+			Data: tokens.Top().Data,
+			Type: semantics.Int,
+		}, nil
+	} else if tokens.Top().Kind == tokenizer.Char_literal {
+		return &ASTNode{
+			Kind: Term,
+			Data: tokens.Top().Data,
+			Type: semantics.Char,
+		}, nil
+	} else if tokens.Top().Kind == tokenizer.Null_literal {
+		return &ASTNode{
+			Kind: Term,
+			Data: tokens.Top().Data,
+			Type: semantics.Null,
+		}, nil
+	} else if tokens.Top().Kind == tokenizer.Identifier {
+		if variable, ok := parserData.variable(tokens.Top().Data); ok && variable.IsArray() {
+			return parseIndex(variable, tokens, parserData)
+		} else if ok {
+			ident := &ASTNode{
+				Kind:    Identifier,
+				Data:    parserData.variableKey(tokens.Top().Data),
+				Type:    variable.Type,
+				Mutable: variable.Mutable,
+			}
+
+			var err error
+			for tokens.Peek(1).Kind == tokenizer.Dot {
+				tokens.Next()
+
+				ident, err = parseField(ident, tokens)
 				if err != nil {
 					return &ASTNode{}, err
 				}
+			}
+
+			return ident, nil
+		} else {
+			return &ASTNode{}, fmt.Errorf("Variable: '%v' not declared", tokens.Top().Data)
+		}
+	}
+
+	return &ASTNode{}, fmt.Errorf("Unrecognized term: '%v'", tokens.Top())
+}
+
+func parseIndex(variable *semantics.Variable, tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	index := &ASTNode{
+		Kind:    Index,
+		Data:    parserData.variableKey(tokens.Top().Data),
+		Type:    variable.Type,
+		Mutable: variable.Mutable,
+	}
 
-				if tokens.Top().Kind != tokenizer.Close_paren || tokens.Top().Kind != tokenizer.Comma {
-					tokens.Next()
-				}
-				lookahead = tokens.Peek(1)
+	if tokens.Peek(1).Kind != tokenizer.Open_square {
+		return &ASTNode{}, fmt.Errorf("Array '%v' used without an index", index.Data)
+	}
+
+	tokens.Next()
+	tokens.Next()
+
+	expr, err := parseExpression(tokens, 0, parserData)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	if expr.Type != semantics.Int {
+		return &ASTNode{}, fmt.Errorf("Index into '%v' must be of type %v, got %v", index.Data, semantics.Int.String(), expr.Type.String())
+	}
+
+	if expr.Kind == Term {
+		i, err := semantics.LiteralValue(expr.Data, expr.Type)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if i < 0 || i >= variable.Length {
+			return &ASTNode{}, fmt.Errorf("Index %v out of range for '%v' with length %v", i, index.Data, variable.Length)
+		}
+	}
+
+	if tokens.Top().Kind != tokenizer.Close_square {
+		return &ASTNode{}, fmt.Errorf("Expected ']' after index into '%v', got '%v'", index.Data, tokens.Top().Data)
+	}
+
+	index.Children = append(index.Children, *expr)
+
+	return index, nil
+}
+
+func parseArrayLength(tokens *tokenizer.TokenStack, parserData *ParserData) (int, error) {
+	// returns -1 when the length is left to be inferred from an initializer
+	tokens.Next()
+
+	if tokens.Top().Kind == tokenizer.Close_square {
+		return -1, nil
+	}
+
+	expr, err := parseExpression(tokens, 0, parserData)
+	if err != nil {
+		return 0, err
+	}
+
+	length, ok, err := constValue(expr, parserData)
+	if err != nil {
+		return 0, err
+	} else if !ok || expr.Type != semantics.Int {
+		return 0, fmt.Errorf("Array length must be a constant int expression")
+	}
+
+	if length <= 0 {
+		return 0, fmt.Errorf("Array length must be positive, got %v", length)
+	}
+
+	if tokens.Top().Kind != tokenizer.Close_square {
+		return 0, fmt.Errorf("Expected ']' after array length, got '%v'", tokens.Top().Data)
+	}
+
+	return length, nil
+}
+
+func parseArrayLiteral(variable *semantics.Variable, tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	array := &ASTNode{
+		Kind: Array,
+		Type: variable.Type,
+	}
+
+	if tokens.Top().Kind != tokenizer.Open_square {
+		return &ASTNode{}, fmt.Errorf("Expected array literal, got '%v'", tokens.Top().Data)
+	}
+
+	tokens.Next()
+
+	for tokens.Top().Kind != tokenizer.Close_square {
+		if tokens.Top().Kind == tokenizer.CR {
+			tokens.Next()
+			continue
+		}
+
+		expr, err := parseExpression(tokens, 0, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if !semantics.Assignable(variable.Type, expr.Type) {
+			return &ASTNode{}, fmt.Errorf("Array element (type: %v) does not match element type %v", expr.Type.String(), variable.Type.String())
+		}
+
+		array.Children = append(array.Children, *expr)
+
+		if tokens.Top().Kind == tokenizer.Comma {
+			tokens.Next()
+		}
+	}
+
+	tokens.Next()
+
+	if variable.Length < 0 {
+		variable.Length = len(array.Children)
+	}
+
+	if len(array.Children) == 0 || len(array.Children) > variable.Length {
+		return &ASTNode{}, fmt.Errorf("Array literal with %v elements does not fit array of length %v", len(array.Children), variable.Length)
+	}
+
+	array.Data = "[" + strconv.Itoa(len(array.Children)) + "]"
+
+	return array, nil
+}
+
+func parseStruct(tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	decl := &ASTNode{
+		Kind: Struct,
+	}
+
+	tokens.Next()
+
+	if tokens.Top().Kind != tokenizer.Identifier {
+		return &ASTNode{}, fmt.Errorf("Expected struct name after 'struct', got '%v'", tokens.Top().Data)
+	}
+
+	decl.Data = tokens.Top().Data
+
+	// declared before its fields so they can point to it, structs in global scope already are
+	var err error
+	decl.Type, err = semantics.MatchType(parserData.qualify(decl.Data))
+	if err != nil || parserData.function != "" {
+		decl.Type, err = semantics.DeclareStruct(parserData.qualify(decl.Data))
+	}
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	tokens.Next()
+
+	if tokens.Top().Kind != tokenizer.Open_curl {
+		return &ASTNode{}, fmt.Errorf("Expected '{' after struct %v, got '%v'", decl.Data, tokens.Top().Data)
+	}
+
+	tokens.Next()
+
+	var fields []semantics.Field
+	for tokens.Top().Kind != tokenizer.Close_curl {
+		if tokens.Top().Kind == tokenizer.CR || tokens.Top().Kind == tokenizer.Comma {
+			tokens.Next()
+			continue
+		}
+
+		typ, err := parseType(tokens, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		tokens.Next()
+
+		if tokens.Top().Kind == tokenizer.Open_square {
+			return &ASTNode{}, fmt.Errorf("Array fields not supported in struct %v", decl.Data)
+		} else if tokens.Top().Kind != tokenizer.Identifier {
+			return &ASTNode{}, fmt.Errorf("Expected field name in struct %v, got '%v'", decl.Data, tokens.Top().Data)
+		}
+
+		fields = append(fields, semantics.Field{Name: tokens.Top().Data, Type: typ})
+		decl.Children = append(decl.Children, ASTNode{Kind: Declaration, Data: tokens.Top().Data, Type: typ})
+
+		tokens.Next()
+	}
+
+	tokens.Next()
+
+	err = semantics.DefineStruct(decl.Type, fields)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	return decl, nil
+}
+
+func parseStructLiteral(typ semantics.Type, tokens *tokenizer.TokenStack, parserData *ParserData) (*ASTNode, error) {
+	literal := &ASTNode{
+		Kind: Struct,
+		Data: tokens.Top().Data,
+		Type: typ,
+	}
+
+	tokens.Next()
+	tokens.Next()
+
+	// fields left out of the literal are zeroed
+	seen := make(map[string]bool)
+	for tokens.Top().Kind != tokenizer.Close_curl {
+		if tokens.Top().Kind == tokenizer.CR || tokens.Top().Kind == tokenizer.Comma {
+			tokens.Next()
+			continue
+		}
+
+		field, err := typ.Field(tokens.Top().Data)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if seen[field.Name] {
+			return &ASTNode{}, fmt.Errorf("Field '%v' given twice in %v literal", field.Name, typ.String())
+		}
+		seen[field.Name] = true
+
+		tokens.Next()
+
+		if tokens.Top().Kind != tokenizer.Colon {
+			return &ASTNode{}, fmt.Errorf("Expected ':' after field '%v' in %v literal, got '%v'", field.Name, typ.String(), tokens.Top().Data)
+		}
+
+		tokens.Next()
+
+		expr, err := parseExpression(tokens, 0, parserData)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+
+		if !semantics.Assignable(field.Type, expr.Type) {
+			return &ASTNode{}, fmt.Errorf("Attempted to assign expression (type: %v) to field '%v' (type: %v)", expr.Type.String(), field.Name, field.Type.String())
+		}
+
+		literal.Children = append(literal.Children, ASTNode{
+			Kind:     Field,
+			Data:     field.Name,
+			Type:     field.Type,
+			Children: []ASTNode{*expr},
+		})
+	}
+
+	tokens.Next()
+
+	return literal, nil
+}
+
+func parseField(base *ASTNode, tokens *tokenizer.TokenStack) (*ASTNode, error) {
+	// expects '.' on top, leaves the field name on top
+	if base.Type.IsPointer() && base.Type.Elem().IsStruct() {
+		var err error
+		base, err = dereference(base)
+		if err != nil {
+			return &ASTNode{}, err
+		}
+	}
+
+	if !base.Type.IsStruct() {
+		return &ASTNode{}, fmt.Errorf("'%v' (type: %v) has no fields", base.Data, base.Type.String())
+	}
+
+	tokens.Next()
+
+	field, err := base.Type.Field(tokens.Top().Data)
+	if err != nil {
+		return &ASTNode{}, err
+	}
+
+	return &ASTNode{
+		Kind:     Field,
+		Data:     field.Name,
+		Type:     field.Type,
+		Mutable:  base.Mutable,
+		Children: []ASTNode{*base},
+	}, nil
+}
+
+func constValue(node *ASTNode, parserData *ParserData) (int, bool, error) {
+	// evaluates expressions built from literals, constants and pure builtins,
+	// returning false for expressions only known at runtime
+	if node.Type != semantics.Int && node.Type != semantics.Char {
+		return 0, false, nil
+	}
+
+	switch node.Kind {
+	case Term:
+		value, err := semantics.LiteralValue(node.Data, node.Type)
+		return value, err == nil, err
+	case Identifier:
+		variable, ok := parserData.declared(node.Data)
+		if !ok || !variable.Constant {
+			return 0, false, nil
+		}
+
+		return variable.Value, true, nil
+	case Expression:
+		if len(node.Children) != 2 {
+			return 0, false, nil
+		}
+
+		lhs, ok, err := constValue(&node.Children[0], parserData)
+		if !ok || err != nil {
+			return 0, false, err
+		}
+
+		rhs, ok, err := constValue(&node.Children[1], parserData)
+		if !ok || err != nil {
+			return 0, false, err
+		}
+
+		value, err := foldBinary(node.Data, lhs, rhs, node.Type)
+		return value, err == nil, err
+	case Call:
+		function, ok := (*parserData.funcs)[node.Data]
+		if !ok || function.Fold == nil {
+			return 0, false, nil
+		}
 
+		args := make([]int, len(node.Children))
+		for i := range node.Children {
+			value, ok, err := constValue(&node.Children[i], parserData)
+			if !ok || err != nil {
+				return 0, false, err
 			}
-			expr.Children[0] = *lhs
-			expr.Children[1] = *rhs
-			expr.Type = lhs.Type
+			args[i] = value
+		}
+
+		value, err := function.Fold(args)
+		return value, err == nil, err
+	default:
+		return 0, false, nil
+	}
+}
+
+func foldBinary(operator string, lhs int, rhs int, typ semantics.Type) (int, error) {
+	var value int
+	overflow := false
+
+	switch operator {
+	case "+":
+		value = lhs + rhs
+		overflow = (rhs > 0 && value < lhs) || (rhs < 0 && value > lhs)
+	case "-":
+		value = lhs - rhs
+		overflow = (rhs > 0 && value > lhs) || (rhs < 0 && value < lhs)
+	case "*":
+		value = lhs * rhs
+		overflow = lhs != 0 && (value/lhs != rhs || (lhs == -1 && rhs == math.MinInt))
+	case "/":
+		if rhs == 0 {
+			return 0, fmt.Errorf("Division by zero in constant expression %v / %v", lhs, rhs)
+		}
+		value = lhs / rhs
+		overflow = lhs == math.MinInt && rhs == -1
+	default:
+		return 0, fmt.Errorf("Operator '%v' not implemented in constant expressions", operator)
+	}
+
+	lo, hi, err := typ.Bounds()
+	if err != nil {
+		return 0, err
+	}
+
+	if overflow || value < lo || value > hi {
+		return 0, fmt.Errorf("Constant expression %v %v %v overflows %v", lhs, operator, rhs, typ.String())
+	}
 
-			lookahead = tokens.Peek(1)
+	return value, nil
+}
 
-			lhs = expr
+func constTerm(typ semantics.Type, value int) *ASTNode {
+	data := strconv.Itoa(value)
+	if typ == semantics.Char {
+		data = fmt.Sprintf("'\\x%02x'", value)
+		if value >= ' ' && value <= '~' && value != '\'' && value != '\\' {
+			data = "'" + string(rune(value)) + "'"
 		}
-		if tokens.Peek(1).Kind == tokenizer.Close_paren || tokens.Peek(1).Kind == tokenizer.Comma {
+	}
+
+	return &ASTNode{
+		Kind: Term,
+		Data: data,
+		Type: typ,
+	}
+}
+
+func dereference(pointer *ASTNode) (*ASTNode, error) {
+	if !pointer.Type.IsPointer() {
+		return &ASTNode{}, fmt.Errorf("Cannot dereference '%v' (type: %v)", pointer.Data, pointer.Type.String())
+	}
+
+	return &ASTNode{
+		Kind:     Dereference,
+		Data:     "*",
+		Type:     pointer.Type.Elem(),
+		Mutable:  pointer.Type.ElemMutable(),
+		Children: []ASTNode{*pointer},
+	}, nil
+}
+
+func checkPointerArithmetic(operator string, lhs semantics.Type, rhs semantics.Type) error {
+	if lhs == semantics.Null || rhs == semantics.Null {
+		return fmt.Errorf("Operator '%v' not defined for null", operator)
+	} else if rhs.IsPointer() {
+		return fmt.Errorf("Operator '%v' not defined for pointer operand of type %v", operator, rhs.String())
+	} else if !lhs.IsPointer() {
+		return nil
+	}
+
+	if operator != "+" && operator != "-" {
+		return fmt.Errorf("Operator '%v' not defined for pointer type %v", operator, lhs.String())
+	} else if lhs.Elem().Size() != 1 {
+		// offsets count bytes, so only pointers to one byte elements, byte and char, can be moved
+		return fmt.Errorf("Pointer arithmetic only supported on byte and char pointers, got %v", lhs.String())
+	} else if rhs != semantics.Int {
+		return fmt.Errorf("Pointer offset must be of type %v, got %v", semantics.Int.String(), rhs.String())
+	}
+
+	return nil
+}
+
+func parseType(tokens *tokenizer.TokenStack, parserData *ParserData) (semantics.Type, error) {
+	// leaves the last token of the type on top
+	if tokens.Top().Kind == tokenizer.Identifier {
+		typ, length, err := parserData.structAt(tokens, 0)
+		for i := 1; i < length; i++ {
 			tokens.Next()
 		}
-		return lhs, nil
+
+		return typ, err
+	} else if tokens.Top().Kind != tokenizer.Operator_star {
+		return semantics.MatchType(tokens.Top().Data)
+	}
+
+	tokens.Next()
+
+	mutable := tokens.Top().Data == "mut"
+	if mutable {
+		tokens.Next()
+	}
+
+	elem, err := parseType(tokens, parserData)
+	if err != nil {
+		return -1, err
 	}
+
+	return semantics.PointerTo(elem, mutable), nil
 }
 
-func parseTerm(tokens *tokenizer.TokenStack, vars *semantics.VarMap) (*ASTNode, error) {
-	if tokens.Top().Kind == tokenizer.Int_literal {
-		return &ASTNode{
-			Kind: Term,
-			Data: tokens.Top().Data,
-			Type: semantics.Int,
-		}, nil
-	} else if tokens.Top().Kind == tokenizer.Char_literal {
-		return &ASTNode{
-			Kind: Term,
-			Data: tokens.Top().Data,
-			Type: semantics.Char,
-		}, nil
-	} else if tokens.Top().Kind == tokenizer.Identifier {
-		if variable, ok := (*vars)[tokens.Top().Data]; ok {
-			return &ASTNode{
-				Kind:    Identifier,
-				Data:    tokens.Top().Data,
-				Type:    variable.Type,
-				Mutable: variable.Mutable,
-			}, nil
-		} else {
-			return &ASTNode{}, fmt.Errorf("Variable: '%v' not declared", tokens.Top().Data)
+func isTypeAt(tokens *tokenizer.TokenStack, offset int, parserData *ParserData) bool {
+	// pointer types are recognised by the type they point to
+	for tokens.Peek(offset).Kind == tokenizer.Operator_star {
+		offset++
+		if tokens.Peek(offset).Data == "mut" {
+			offset++
 		}
 	}
 
-	return &ASTNode{}, fmt.Errorf("Unrecognized term: '%v'", tokens.Top())
+	if tokens.Peek(offset).Kind == tokenizer.Type {
+		return true
+	}
+
+	_, length, _ := parserData.structAt(tokens, offset)
+
+	return tokens.Peek(offset).Kind == tokenizer.Identifier && length > 0
+}
+
+func typeLength(tokens *tokenizer.TokenStack, offset int, parserData *ParserData) int {
+	// returns the number of tokens spanned by the type starting at offset
+	length := 0
+	for tokens.Peek(offset+length).Kind == tokenizer.Operator_star {
+		length++
+		if tokens.Peek(offset+length).Data == "mut" {
+			length++
+		}
+	}
+
+	if _, name, _ := parserData.structAt(tokens, offset+length); name > 0 {
+		length += name
+	} else {
+		length++
+	}
+	if tokens.Peek(offset+length).Kind != tokenizer.Open_square {
+		return length
+	}
+
+	for tokens.Peek(offset+length).Kind != tokenizer.Close_square {
+		length++
+	}
+
+	return length + 1
 }
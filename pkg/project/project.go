@@ -0,0 +1,92 @@
+// Package project reads the project file describing how to build a multi-file program
+package project
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Filename is the name of the project file, kept at the root of a project
+const Filename = "penguin.json"
+
+// Project lists what to build. Paths are relative to the directory holding the project file
+type Project struct {
+	Dir       string   `json:"-"`
+	Entry     string   `json:"entry"`      // file of the program, holding main
+	Sources   []string `json:"sources"`    // directories imports are looked up in, in order, defaulting to that of the entry
+	Output    string   `json:"output"`     // executable built, defaulting to the entry without its extension
+	OutDir    string   `json:"out_dir"`    // directory artifacts are written to instead of that of output, keeping its name
+	Libs      []string `json:"libs"`       // libraries linked with -l, which links through the C compiler
+	LinkFlags []string `json:"link_flags"` // passed as they are to ld, or to cc when linking through the C compiler
+}
+
+// Find looks for the project file in dir and the directories above it
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, Filename)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("No %v found in this directory or above", Filename)
+		}
+		dir = parent
+	}
+}
+
+// Load reads a project file, resolving its paths against the directory holding it
+func Load(path string) (Project, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return Project{}, err
+	}
+
+	var project Project
+	decoder := json.NewDecoder(bytes.NewReader(dat))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&project); err != nil {
+		return Project{}, fmt.Errorf("%v: %v", path, err)
+	}
+
+	if project.Entry == "" {
+		return Project{}, fmt.Errorf("%v: No entry file given", path)
+	}
+
+	project.Dir = filepath.Dir(path)
+	project.Entry = filepath.Join(project.Dir, project.Entry)
+
+	if len(project.Sources) == 0 {
+		project.Sources = []string{filepath.Dir(project.Entry)}
+	} else {
+		for i, source := range project.Sources {
+			project.Sources[i] = filepath.Join(project.Dir, source)
+
+			if info, err := os.Stat(project.Sources[i]); err != nil || !info.IsDir() {
+				return Project{}, fmt.Errorf("%v: Source directory '%v' not found", path, source)
+			}
+		}
+	}
+
+	if project.Output == "" {
+		project.Output = project.Entry[:len(project.Entry)-len(filepath.Ext(project.Entry))]
+	} else {
+		project.Output = filepath.Join(project.Dir, project.Output)
+	}
+
+	if project.OutDir != "" {
+		project.OutDir = filepath.Join(project.Dir, project.OutDir)
+		project.Output = filepath.Join(project.OutDir, filepath.Base(project.Output))
+	}
+
+	return project, nil
+}
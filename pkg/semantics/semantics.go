@@ -2,7 +2,9 @@ package semantics
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 )
 
 type Type int
@@ -14,41 +16,238 @@ const (
 	Int
 	Char
 	Float
+	Null
+	Void // the unit type returned by functions without a result
 )
 
-func (typ Type) String() string {
-	name := []string{
-		"Untyped",
-		"Byte",
-		"Bool",
-		"Int",
-		"Char",
-		"Float",
+type TypeKind int
+
+const (
+	ScalarKind TypeKind = iota + 0
+	StructKind
+	PointerKind
+)
+
+// TypeInfo describes the memory layout of a type in TypeTable
+type TypeInfo struct {
+	Name      string
+	Kind      TypeKind
+	Size      int // in bytes
+	Alignment int // in bytes
+	Fields    []Field
+	Elem      Type // type pointed to by pointers
+	Mutable   bool // whether values can be written through pointers
+	Public    bool // structs declared 'pub' can be named by other modules
+}
+
+type Field struct {
+	Name   string
+	Type   Type
+	Offset int // in bytes from the start of the struct
+}
+
+// TypeTable holds every type known to the compiler, indexed by Type.
+// Builtin types occupy the first entries, struct and pointer types are appended as they are declared
+var TypeTable = builtinTypes()
+
+func builtinTypes() []TypeInfo {
+	return []TypeInfo{
+		{Name: "Untyped", Size: -1, Alignment: 1},
+		{Name: "Byte", Size: 1, Alignment: 1},
+		{Name: "Bool", Size: 1, Alignment: 1},
+		{Name: "Int", Size: 8, Alignment: 8},
+		{Name: "Char", Size: 1, Alignment: 1},
+		{Name: "Float", Size: 8, Alignment: 8},
+		{Name: "Null", Size: 8, Alignment: 8},
+		{Name: "Void", Size: 0, Alignment: 1},
 	}
+}
 
-	i := int(typ)
-	switch {
-	case i <= int(Float):
-		return name[i]
-	default:
-		return strconv.Itoa(i)
+// ResetTypes removes all declared struct and pointer types from TypeTable.
+// generator.DeclareBuiltins calls it at the start of every compilation
+func ResetTypes() {
+	TypeTable = builtinTypes()
+}
+
+func (typ Type) info() (TypeInfo, bool) {
+	if typ < 0 || int(typ) >= len(TypeTable) {
+		return TypeInfo{}, false
 	}
 
+	return TypeTable[typ], true
+}
+
+func (typ Type) String() string {
+	if info, ok := typ.info(); ok {
+		return info.Name
+	}
+
+	return strconv.Itoa(int(typ))
 }
 
 func (typ Type) Size() int {
 	// returns size in bytes
+	if info, ok := typ.info(); ok {
+		return info.Size
+	}
+
+	return -1
+}
+
+func (typ Type) Alignment() int {
+	if info, ok := typ.info(); ok {
+		return info.Alignment
+	}
+
+	return 1
+}
+
+func (typ Type) IsStruct() bool {
+	info, ok := typ.info()
+
+	return ok && info.Kind == StructKind
+}
+
+func (typ Type) IsPointer() bool {
+	info, ok := typ.info()
+
+	return ok && info.Kind == PointerKind
+}
+
+func (typ Type) Elem() Type {
+	// returns the type pointed to by a pointer type
+	info, _ := typ.info()
+
+	return info.Elem
+}
+
+func (typ Type) ElemMutable() bool {
+	info, _ := typ.info()
+
+	return info.Mutable
+}
+
+func PointerTo(elem Type, mutable bool) Type {
+	for i, info := range TypeTable {
+		if info.Kind == PointerKind && info.Elem == elem && info.Mutable == mutable {
+			return Type(i)
+		}
+	}
+
+	name := "*" + elem.String()
+	if mutable {
+		name = "*mut " + elem.String()
+	}
+
+	TypeTable = append(TypeTable, TypeInfo{Name: name, Kind: PointerKind, Size: 8, Alignment: 8, Elem: elem, Mutable: mutable})
+
+	return Type(len(TypeTable) - 1)
+}
+
+func Assignable(to Type, from Type) bool {
+	if to == from {
+		return true
+	} else if from == Null {
+		return to.IsPointer()
+	}
+
+	if !to.IsPointer() || !from.IsPointer() || (to.ElemMutable() && !from.ElemMutable()) {
+		return false
+	}
+
+	// pointers to mutable values may be used where pointers to immutable values are expected,
+	// byte pointers convert to and from any other pointer
+	return to.Elem() == from.Elem() || to.Elem() == Byte || from.Elem() == Byte
+}
+
+func (typ Type) Field(name string) (Field, error) {
+	info, _ := typ.info()
+	for _, field := range info.Fields {
+		if field.Name == name {
+			return field, nil
+		}
+	}
+
+	return Field{}, fmt.Errorf("Type %v has no field '%v'", typ.String(), name)
+}
+
+func (typ Type) Fields() []Field {
+	info, _ := typ.info()
+
+	return info.Fields
+}
+
+// DeclareStruct reserves a struct type so its fields can point to it before DefineStruct lays it out
+func DeclareStruct(name string) (Type, error) {
+	if _, err := MatchType(name); err == nil {
+		return -1, fmt.Errorf("Type %v already declared", name)
+	}
+
+	TypeTable = append(TypeTable, TypeInfo{Name: name, Kind: StructKind, Size: -1, Alignment: 1})
+
+	return Type(len(TypeTable) - 1), nil
+}
+
+// MakePublic lets other modules name a struct type
+func MakePublic(typ Type) {
+	TypeTable[typ].Public = true
+}
+
+func (typ Type) IsPublic() bool {
+	info, _ := typ.info()
+
+	return info.Public
+}
+
+// DefineStruct lays out fields in declaration order, padding each to its alignment
+func DefineStruct(typ Type, fields []Field) error {
+	name := typ.String()
+
+	if len(fields) == 0 {
+		return fmt.Errorf("Struct %v has no fields", name)
+	}
+
+	info := TypeInfo{Name: name, Kind: StructKind, Alignment: 1, Public: TypeTable[typ].Public}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if seen[field.Name] {
+			return fmt.Errorf("Duplicate field '%v' in struct %v", field.Name, name)
+		}
+		seen[field.Name] = true
+
+		if field.Type.Size() <= 0 {
+			return fmt.Errorf("Field '%v' in struct %v has unsized type %v", field.Name, name, field.Type.String())
+		}
+
+		align := field.Type.Alignment()
+		if align > info.Alignment {
+			info.Alignment = align
+		}
+
+		field.Offset = alignTo(info.Size, align)
+		info.Size = field.Offset + field.Type.Size()
+		info.Fields = append(info.Fields, field)
+	}
+	info.Size = alignTo(info.Size, info.Alignment)
+
+	TypeTable[typ] = info
+
+	return nil
+}
+
+func alignTo(offset int, align int) int {
+	return (offset + align - 1) / align * align
+}
+
+func (typ Type) Bounds() (int, int, error) {
+	// returns the smallest and largest value representable by an integral type
 	switch typ {
-	case Bool:
-		return 2
 	case Int:
-		return 4
+		return math.MinInt, math.MaxInt, nil
 	case Char:
-		return 4
-	case Float:
-		return 8
+		return 0, math.MaxUint8, nil
 	default:
-		return -1
+		return 0, 0, fmt.Errorf("Type %v has no integral bounds", typ.String())
 	}
 }
 
@@ -56,7 +255,23 @@ type Variable struct {
 	Mutable       bool
 	Type          Type
 	StackLocation int
+	Length        int // number of elements for arrays, 0 for scalars
 	IsGlobal      bool
+	Constant      bool // Value is known at compile time
+	Value         int
+}
+
+func (variable Variable) IsArray() bool {
+	return variable.Length != 0
+}
+
+func (variable Variable) Size() int {
+	// returns size in bytes
+	if variable.IsArray() {
+		return variable.Length * variable.Type.Size()
+	}
+
+	return variable.Type.Size()
 }
 
 type VarMap map[string]*Variable
@@ -65,18 +280,120 @@ type Function struct {
 	Mutable   bool
 	Type      Type
 	Signature string
-	NumArgs   int
+	Params    []Param
+	Vars      VarMap                        // parameters and locals, never named like a global of their module
+	Extern    bool                          // defined outside penguin and called with the C ABI
+	Exported  bool                          // callable from C under its unmangled name
+	Library   bool                          // part of the standard library, only generated when called
+	Builtin   bool                          // provided by the compiler, visible from every module
+	Public    bool                          // declared 'pub', callable from other modules
+	Variadic  bool                          // accepts extra scalar arguments after Params, declared with '...'
+	MaxArgs   int                           // bounds the arguments of variadic functions in total, 0 for no bound
+	Fold      func(args []int) (int, error) // evaluates calls with constant arguments, nil unless the function is pure
+}
+
+type Param struct {
+	Name    string
+	Type    Type
+	Mutable bool
 }
 
 type FuncMap map[string]*Function
 
+// Symbol turns the key of a declaration in a module, such as "geo/shapes.area", into a name the assembler accepts
+func Symbol(key string) string {
+	return strings.ReplaceAll(key, "/", ".")
+}
+
+// ParseSignature reads the parameters of a builtin signature such as "min(int, int)" or "free(*mut byte)"
+func ParseSignature(signature string) ([]Param, error) {
+	open := strings.Index(signature, "(")
+	if open < 0 || !strings.HasSuffix(signature, ")") {
+		return nil, fmt.Errorf("Malformed signature %v", signature)
+	}
+
+	// further arguments of variadic functions are checked by the parser
+	list := strings.TrimSpace(signature[open+1 : len(signature)-1])
+	list = strings.TrimSpace(strings.TrimSuffix(list, "..."))
+	list = strings.TrimSuffix(list, ",")
+
+	var params []Param
+	if list == "" {
+		return params, nil
+	}
+
+	for _, param := range strings.Split(list, ",") {
+		typ, err := ParseTypeName(strings.TrimSpace(param))
+		if err != nil {
+			return nil, fmt.Errorf("%v in signature %v", err, signature)
+		}
+
+		params = append(params, Param{Type: typ})
+	}
+
+	return params, nil
+}
+
+// ParseTypeName reads a type written as in a signature, such as "int" or "*mut byte"
+func ParseTypeName(str string) (Type, error) {
+	if !strings.HasPrefix(str, "*") {
+		return MatchType(str)
+	}
+
+	str = strings.TrimSpace(str[1:])
+	mutable := strings.HasPrefix(str, "mut ")
+	if mutable {
+		str = strings.TrimSpace(str[len("mut "):])
+	}
+
+	elem, err := ParseTypeName(str)
+	if err != nil {
+		return -1, err
+	}
+
+	return PointerTo(elem, mutable), nil
+}
+
 func MatchType(str string) (Type, error) {
 	switch {
 	case str == "int":
 		return Int, nil
 	case str == "char":
 		return Char, nil
+	case str == "byte":
+		return Byte, nil
+	case str == "void":
+		return Void, nil
+	}
+
+	for i, info := range TypeTable {
+		if info.Name == str && Type(i).IsStruct() {
+			return Type(i), nil
+		}
+	}
+
+	return -1, fmt.Errorf("Type %v not implemented", str)
+}
+
+func LiteralValue(data string, typ Type) (int, error) {
+	switch typ {
+	case Int:
+		return strconv.Atoi(data)
+	case Char:
+		if len(data) < 3 || data[0] != '\'' || data[len(data)-1] != '\'' {
+			return 0, fmt.Errorf("Malformed char literal %v", data)
+		}
+
+		value, _, tail, err := strconv.UnquoteChar(data[1:len(data)-1], '\'')
+		if err != nil {
+			return 0, err
+		}
+		if tail != "" {
+			return 0, fmt.Errorf("Char literal %v contains more than one character", data)
+		}
+
+		return int(value), nil
 	default:
-		return -1, fmt.Errorf("Type %v not implemented", str)
+		return 0, fmt.Errorf("Literal values not implemented for type %v", typ.String())
 	}
 }
@@ -0,0 +1,49 @@
+// Package std is the standard library, written in penguin and parsed before every program
+package std
+
+import (
+	"embed"
+
+	"github.com/GenM4/penguin/pkg/parser"
+	"github.com/GenM4/penguin/pkg/semantics"
+	"github.com/GenM4/penguin/pkg/tokenizer"
+)
+
+//go:embed *.pn
+var sources embed.FS
+
+// Load parses the standard library into vars and funcs and returns its declarations.
+// It is the prelude module, whose public functions and structs every file can use unqualified.
+// Its functions are marked as library functions, which are only generated when called
+func Load(vars *semantics.VarMap, funcs *semantics.FuncMap) *parser.ASTNode {
+	entries, err := sources.ReadDir(".")
+	if err != nil {
+		panic(err)
+	}
+
+	// the files are parsed as one so they can call each other
+	var tokens tokenizer.TokenStack
+	for _, entry := range entries {
+		dat, err := sources.ReadFile(entry.Name())
+		if err != nil {
+			panic(err)
+		}
+
+		tokens.Tokens = append(tokens.Tokens, tokenizer.Tokenize(dat).Tokens...)
+	}
+
+	declared := make(map[string]bool)
+	for name := range *funcs {
+		declared[name] = true
+	}
+
+	root := parser.ParseModule(&tokens, parser.Prelude, nil, vars, funcs)
+
+	for name, function := range *funcs {
+		if !declared[name] {
+			function.Library = true
+		}
+	}
+
+	return root
+}
@@ -11,11 +11,12 @@ import (
 type TokenType int
 
 const (
-	Std_Function TokenType = iota + 0
-	Open_curl
+	Open_curl TokenType = iota + 0
 	Close_curl
 	Open_paren
 	Close_paren
+	Open_square
+	Close_square
 	Comma
 	Return
 	CR
@@ -30,16 +31,33 @@ const (
 	Mutable
 	Type
 	SingleEqual
+	Match
+	Arrow
+	Range
+	Wildcard
+	Struct
+	Dot
+	Colon
+	Ampersand
+	Null_literal
+	Extern
+	Export
+	Asm
+	Asm_body
+	Import
+	Pub
+	String_literal
 	Identifier
 )
 
 func (tokenType TokenType) String() string {
 	name := []string{
-		"Std_Function",
 		"Open_curl",
 		"Close_curl",
 		"Open_paren",
 		"Close_paren",
+		"Open_square",
+		"Close_square",
 		"Comma",
 		"Return",
 		"CR",
@@ -54,6 +72,22 @@ func (tokenType TokenType) String() string {
 		"Mutable",
 		"Type",
 		"Equal",
+		"Match",
+		"Arrow",
+		"Range",
+		"Wildcard",
+		"Struct",
+		"Dot",
+		"Colon",
+		"Ampersand",
+		"Null_Literal",
+		"Extern",
+		"Export",
+		"Asm",
+		"Asm_Body",
+		"Import",
+		"Pub",
+		"String_Literal",
 		"Identifier",
 	}
 
@@ -72,6 +106,8 @@ var TokenDict = map[string]TokenType{
 	"}":      Close_curl,
 	"(":      Open_paren,
 	")":      Close_paren,
+	"[":      Open_square,
+	"]":      Close_square,
 	",":      Comma,
 	"return": Return,
 	"\n":     CR,
@@ -85,24 +121,35 @@ var TokenDict = map[string]TokenType{
 	"const":  Mutable,
 	"int":    Type,
 	"char":   Type,
+	"byte":   Type,
+	"void":   Type,
 	"=":      SingleEqual,
-}
-
-type StdLibFunction int
-
-var StdLibDict = map[string]string{
-	"exit":  "exit(int)",
-	"print": "print(char)",
+	"match":  Match,
+	"=>":     Arrow,
+	"..":     Range,
+	"_":      Wildcard,
+	"struct": Struct,
+	".":      Dot,
+	":":      Colon,
+	"&":      Ampersand,
+	"null":   Null_literal,
+	"extern": Extern,
+	"export": Export,
+	"asm":    Asm,
+	"import": Import,
+	"pub":    Pub,
 }
 
 type Token struct {
 	Data string
 	Kind TokenType
+	Line int
 }
 
 type TokenStack struct {
 	Tokens []Token
 	index  int
+	line   int // line of the next token appended
 }
 
 func (toks TokenStack) Append(buf string) TokenStack {
@@ -118,12 +165,32 @@ func (toks TokenStack) Append(buf string) TokenStack {
 	tok := Token{
 		Data: buf,
 		Kind: kind,
+		Line: toks.line,
+	}
+	toks.Tokens = append(toks.Tokens, tok)
+
+	return toks
+}
+
+func (toks TokenStack) appendRaw(data string, kind TokenType) TokenStack {
+	tok := Token{
+		Data: data,
+		Kind: kind,
+		Line: toks.line,
 	}
 	toks.Tokens = append(toks.Tokens, tok)
 
 	return toks
 }
 
+func (toks TokenStack) lastKind() TokenType {
+	if len(toks.Tokens) == 0 {
+		return -1
+	}
+
+	return toks.Tokens[len(toks.Tokens)-1].Kind
+}
+
 func (toks TokenStack) Top() Token {
 	return toks.Tokens[toks.index]
 }
@@ -173,6 +240,7 @@ func Tokenize(raw []byte) TokenStack {
 
 	var result TokenStack
 	result.index = 0
+	result.line = 1
 
 	last := 0
 	for i := 0; i < len(fileContents); i++ {
@@ -182,6 +250,7 @@ func Tokenize(raw []byte) TokenStack {
 		if curr == '/' && view(fileContents, i+1) == '/' {
 			i += strings.Index(fileContents[i:], "\n")
 			last = i + 1
+			result.line++
 
 			if i == 0 { // EOF
 				break
@@ -196,6 +265,27 @@ func Tokenize(raw []byte) TokenStack {
 			result = result.Append("--")
 			last = i + 2
 			i = i + 1
+		} else if curr == '.' && view(fileContents, i+1) == '.' {
+			result = result.Append(buf)
+			result = result.Append("..")
+			last = i + 2
+			i = i + 1
+		} else if curr == '.' {
+			result = result.Append(buf)
+			result = result.Append(".")
+			last = i + 1
+		} else if curr == '*' {
+			result = result.Append(buf)
+			result = result.Append("*")
+			last = i + 1
+		} else if curr == '&' {
+			result = result.Append(buf)
+			result = result.Append("&")
+			last = i + 1
+		} else if curr == ':' {
+			result = result.Append(buf)
+			result = result.Append(":")
+			last = i + 1
 		} else if curr == '\'' {
 			result = result.Append(buf)
 			i++
@@ -204,6 +294,16 @@ func Tokenize(raw []byte) TokenStack {
 				i++
 				curr = view(fileContents, i)
 			}
+		} else if curr == '"' {
+			// string literals name the modules a file imports and cannot span lines
+			result = result.Append(buf)
+			end := strings.IndexAny(fileContents[i+1:], "\"\n")
+			if end < 0 || fileContents[i+1+end] != '"' {
+				panic(fmt.Errorf("Unterminated string literal on line %v", result.line))
+			}
+			result = result.appendRaw(fileContents[i+1:i+1+end], String_literal)
+			last = i + end + 2
+			i = i + end + 1
 		} else if curr == ',' {
 			result = result.Append(buf)
 			result = result.Append(",")
@@ -216,9 +316,35 @@ func Tokenize(raw []byte) TokenStack {
 			result = result.Append(buf)
 			result = result.Append(")")
 			last = i + 1
+		} else if curr == '{' {
+			result = result.Append(buf)
+			if result.lastKind() == Asm {
+				// the body of an asm block is kept verbatim up to the matching brace
+				end := matchingBrace(fileContents, i)
+				result = result.appendRaw(fileContents[i+1:end], Asm_body)
+				result.line += strings.Count(fileContents[i+1:end], "\n")
+				last = end + 1
+				i = end
+			} else {
+				result = result.Append("{")
+				last = i + 1
+			}
+		} else if curr == '}' {
+			result = result.Append(buf)
+			result = result.Append("}")
+			last = i + 1
+		} else if curr == '[' {
+			result = result.Append(buf)
+			result = result.Append("[")
+			last = i + 1
+		} else if curr == ']' {
+			result = result.Append(buf)
+			result = result.Append("]")
+			last = i + 1
 		} else if curr == '\n' {
 			result = result.Append(buf)
 			result = result.Append("\n")
+			result.line++
 			last = i + 1
 		} else if curr == ' ' {
 			result = result.Append(buf)
@@ -229,11 +355,25 @@ func Tokenize(raw []byte) TokenStack {
 	return result
 }
 
+func matchingBrace(str string, open int) int {
+	depth := 0
+	for i := open; i < len(str); i++ {
+		if str[i] == '{' {
+			depth++
+		} else if str[i] == '}' {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	panic(errors.New("Unterminated asm block"))
+}
+
 func matchToken(tokenAsString string) (TokenType, error) {
 	if result, found := TokenDict[tokenAsString]; found {
 		return result, nil
-	} else if _, found := StdLibDict[tokenAsString]; found {
-		return Std_Function, nil
 	} else if tokenAsString != "" && unicode.IsDigit(rune(tokenAsString[0])) {
 		_, err := strconv.Atoi(tokenAsString)
 		if err != nil {
@@ -242,16 +382,17 @@ func matchToken(tokenAsString string) (TokenType, error) {
 		return Int_literal, nil
 	} else if tokenAsString != "" && isCharConstant(tokenAsString) {
 		return Char_literal, nil
-	} else if isAlphabetic(tokenAsString) {
+	} else if isIdentifier(tokenAsString) {
 		return Identifier, nil
 	} else {
 		return -1, fmt.Errorf("Token Not Recognized: %v", tokenAsString)
 	}
 }
 
-func isAlphabetic(str string) bool {
-	for _, r := range str {
-		if !unicode.IsLetter(r) {
+func isIdentifier(str string) bool {
+	// identifiers start with a letter so they cannot clash with the labels the generator emits
+	for i, r := range str {
+		if !unicode.IsLetter(r) && (i == 0 || (r != '_' && !unicode.IsDigit(r))) {
 			return false
 		}
 	}
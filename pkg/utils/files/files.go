@@ -15,25 +15,41 @@ type FileData struct {
 	AsmFilepath  string
 	ObjFilename  string
 	ObjFilepath  string
+	HdrFilename  string
+	HdrFilepath  string
 	ExecFilepath string
 }
 
-func GenerateFilepaths(args []string) FileData {
+// OutputFilepaths names the artifacts of building src into the executable output, which are written next to it
+// unless moved with TempFilepaths
+func OutputFilepaths(src string, output string) FileData {
 
 	var result FileData
-	result.SrcFilepath = args[len(args)-1]
+	result.SrcFilepath = src
 	result.SrcFilename = filepath.Base(result.SrcFilepath)
-	result.BaseFilepath = filepath.Dir(result.SrcFilepath)
-	result.BaseFilename = removeFileExtension(result.SrcFilename)
+	result.BaseFilepath = filepath.Dir(output)
+	result.BaseFilename = filepath.Base(output)
 	result.AsmFilename = result.BaseFilename + ".asm"
 	result.AsmFilepath = filepath.Join(result.BaseFilepath, result.AsmFilename)
 	result.ObjFilename = result.BaseFilename + ".o"
 	result.ObjFilepath = filepath.Join(result.BaseFilepath, result.ObjFilename)
+	result.HdrFilename = result.BaseFilename + ".h"
+	result.HdrFilepath = filepath.Join(result.BaseFilepath, result.HdrFilename)
 	result.ExecFilepath = filepath.Join(result.BaseFilepath, result.BaseFilename)
 
 	return result
 }
 
+// TempFilepaths moves the assembly, and the object if obj is set, of fileData into the temporary directory dir
+func TempFilepaths(fileData FileData, dir string, obj bool) FileData {
+	fileData.AsmFilepath = filepath.Join(dir, fileData.AsmFilename)
+	if obj {
+		fileData.ObjFilepath = filepath.Join(dir, fileData.ObjFilename)
+	}
+
+	return fileData
+}
+
 func OpenTargetFile(filepath string) *os.File {
 	asmFile, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
@@ -48,7 +64,3 @@ func OpenTargetFile(filepath string) *os.File {
 
 	return asmFile
 }
-
-func removeFileExtension(filename string) string {
-	return filename[:len(filename)-len(filepath.Ext(filename))]
-}
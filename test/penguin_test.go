@@ -0,0 +1,1465 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GenM4/penguin/pkg/generator"
+	"github.com/GenM4/penguin/pkg/module"
+	"github.com/GenM4/penguin/pkg/parser"
+	"github.com/GenM4/penguin/pkg/project"
+	"github.com/GenM4/penguin/pkg/semantics"
+	"github.com/GenM4/penguin/pkg/std"
+	"github.com/GenM4/penguin/pkg/tokenizer"
+)
+
+// compile runs src through the tokenizer, parser and generator and returns
+// the generated assembly, converting compiler panics into errors
+func compile(t *testing.T, src string) (asm string, err error) {
+	return compileProgram(t, map[string]string{"main.pn": src})
+}
+
+// compileProgram compiles main.pn importing the other files, which are named by their path in the program
+func compileProgram(t *testing.T, files map[string]string) (asm string, err error) {
+	return compileWith(t, files, generator.NewRegistry(), generator.Options{})
+}
+
+// compileWith compiles a program with the builtins of registry and the code generation options opts
+func compileWith(t *testing.T, files map[string]string, builtins *generator.Registry, opts generator.Options) (asm string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens := tokenizer.Tokenize([]byte(files["main.pn"]))
+
+	vars := make(semantics.VarMap)
+	funcs := make(semantics.FuncMap)
+	if err := generator.DeclareBuiltins(builtins, &funcs); err != nil {
+		t.Fatal(err)
+	}
+
+	prelude := std.Load(&vars, &funcs)
+	root := module.Load(filepath.Join(dir, "main.pn"), nil, tokens, &vars, &funcs)
+	root.Children = append(prelude.Children, root.Children...)
+
+	out, err := os.Create(filepath.Join(dir, "out.asm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	generator.Generate(root, &vars, &funcs, builtins, opts, out)
+
+	dat, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(dat), nil
+}
+
+// runProgram builds src into an executable, runs it and returns its exit code and output.
+// Tests running programs are skipped where nasm is not installed
+func runProgram(t *testing.T, src string) (int, string) {
+	t.Helper()
+
+	return runProgramInput(t, src, nil)
+}
+
+// runProgramInput runs src like runProgram, reading its standard input from stdin
+func runProgramInput(t *testing.T, src string, stdin io.Reader) (int, string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("nasm"); err != nil {
+		t.Skip("nasm not found, not running the program")
+	}
+
+	asm, err := compile(t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "program")
+	if err := os.WriteFile(path+".asm", []byte(asm), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"nasm", "-felf64", path + ".asm", "-o", path + ".o"}, {"ld", path + ".o", "-o", path}} {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v failed: %v\n%v", args[0], err, string(out))
+		}
+	}
+
+	cmd := exec.Command(path)
+	cmd.Stdin = stdin
+	out, err := cmd.Output()
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), string(out)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return 0, string(out)
+}
+
+func TestMatchJumpTable(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    mut int x = 3
+    match x {
+        0 => print('a')
+        1 => print('b')
+        2..3 => print('c')
+        4 => print('d')
+        _ => print('?')
+    }
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(asm, "jmp [rcx + rax*8]") {
+		t.Errorf("Expected dense match to compile to a jump table:\n%v", asm)
+	}
+
+	_, out := runProgram(t, `
+void show(int x) {
+    match x {
+        0 => print('a')
+        1 => print('b')
+        2..3 => print('c')
+        4 => print('d')
+        _ => print('?')
+    }
+}
+
+int main() {
+    show(0)
+    show(1)
+    show(3)
+    show(4)
+    show(9)
+    show(2)
+    return 0
+}
+`)
+	if out != "abcd?c" {
+		t.Errorf("Expected jump table to pick the arms abcd?c, got %q", out)
+	}
+}
+
+func TestMatchCompareChain(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    mut int x = 3
+    match x {
+        1 => print('a')
+        1000 => print('b')
+        _ => print('?')
+    }
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(asm, "jmp [rcx + rax*8]") || !strings.Contains(asm, "cmp rax, 1000") {
+		t.Errorf("Expected sparse match to compile to a compare chain:\n%v", asm)
+	}
+}
+
+func TestMatchExhaustiveness(t *testing.T) {
+	_, err := compile(t, `
+int main() {
+    mut char c = 'x'
+    match c {
+        '\x00'..'m' => print('a')
+        'n'..'\xff' => print('b')
+    }
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Errorf("Expected match covering every char to compile, got: %v", err)
+	}
+
+	_, err = compile(t, `
+int main() {
+    mut char c = 'x'
+    match c {
+        'a'..'z' => print('a')
+    }
+    exit(0)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "Non-exhaustive") {
+		t.Errorf("Expected non-exhaustive match error, got: %v", err)
+	}
+}
+
+func TestArrayIndexing(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    mut char[] word = ['h', 'i']
+    mut int i = 1
+    word[i] = 'o'
+    print(word[0])
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"mov BYTE [rbp + rcx*1 - 8], al", "movzx rax, BYTE [rbp - 8]", "jae __bounds_error"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	asm, err = compileWith(t, map[string]string{"main.pn": `
+int main() {
+    mut char[] word = ['h', 'i']
+    mut int i = 1
+    print(word[i])
+    exit(0)
+}
+`}, generator.NewRegistry(), generator.Options{NoBoundsChecks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(asm, "__bounds_error") {
+		t.Errorf("Expected no bounds checks:\n%v", asm)
+	}
+
+	_, err = compile(t, `
+int main() {
+    int[4] xs
+    exit(xs[4])
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("Expected constant index out of range error, got: %v", err)
+	}
+}
+
+func TestStructLayout(t *testing.T) {
+	asm, err := compile(t, `
+struct Point { int x  char tag  int y }
+
+Point shift(Point p, int dx) {
+    return Point { x: p.x + dx, y: p.y, tag: p.tag }
+}
+
+int main() {
+    mut Point p = Point { x: 1, y: 2 }
+    p.tag = 'p'
+    exit(shift(p, 3).y)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	point, err := semantics.MatchType("Point")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if y, _ := point.Field("y"); point.Size() != 24 || point.Alignment() != 8 || y.Offset != 16 {
+		t.Errorf("Unexpected layout for Point: size %v, alignment %v, y at offset %v", point.Size(), point.Alignment(), y.Offset)
+	}
+
+	if !strings.Contains(asm, "rep movsb") || !strings.Contains(asm, "mov BYTE [rbp - 40], al") {
+		t.Errorf("Expected struct copies and a byte store to p.tag:\n%v", asm)
+	}
+
+	code, out := runProgram(t, `
+struct Point { int x  char tag  int y }
+
+Point shift(Point p, int dx) {
+    return Point { x: p.x + dx, y: p.y * 2, tag: p.tag }
+}
+
+int main() {
+    mut Point p = Point { x: 1, y: 2 }
+    p.tag = 'p'
+    Point q = shift(p, 3)
+    print(q.tag)
+    return q.x * 10 + q.y
+}
+`)
+	if code != 44 || out != "p" {
+		t.Errorf("Expected struct returned by value to exit with 44 and print p, got %v and %q", code, out)
+	}
+
+	_, err = compile(t, `
+struct Point { int x  int y }
+
+int main() {
+    Point p = Point { x: 1, z: 2 }
+    exit(0)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "no field 'z'") {
+		t.Errorf("Expected unknown field error, got: %v", err)
+	}
+}
+
+func TestPointers(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    mut int x = 1
+    *mut int p = &x
+    *p = 2
+    exit(*p)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"lea rax, [rbp - 8]", "mov QWORD [rdx], rax", "mov rdi, QWORD [rax]"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	_, err = compile(t, `
+int main() {
+    int x = 1
+    *int p = &x
+    *p = 2
+    exit(0)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "immutable value") {
+		t.Errorf("Expected write through immutable pointer error, got: %v", err)
+	}
+
+	_, err = compile(t, `
+int main() {
+    int x = 1
+    *mut int p = &x
+    exit(0)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "Attempted to assign") {
+		t.Errorf("Expected mutable pointer to const error, got: %v", err)
+	}
+	_, err = compile(t, `
+int main() {
+    mut int[2] xs = [1, 2]
+    *int p = &xs[0] + 1
+    exit(0)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "only supported on byte and char pointers, got *mut Int") {
+		t.Errorf("Expected int pointer arithmetic error, got: %v", err)
+	}
+}
+
+func TestHeapRuntime(t *testing.T) {
+	asm, err := compile(t, `
+struct Point { int x  int y }
+
+int main() {
+    *mut Point p = alloc(16)
+    p.y = 2
+    free(p)
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"call __alloc", "call __free", "__alloc:", "__free:", "__heap_free:", "mov QWORD [rdx + 8], rax", "lea rax, [rdi + 16]"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	asm, err = compile(t, `
+int main() {
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(asm, "__alloc") {
+		t.Errorf("Expected heap runtime to be omitted when unused:\n%v", asm)
+	}
+
+	// small and large blocks are usable, 16 byte aligned and reused once freed
+	code, _ := runProgram(t, `
+struct Point { int x  int y }
+
+int misaligned(*mut byte p) {
+    mut int low = 0
+    asm {
+        mov rax, {p}
+        and rax, 15
+        mov {low}, rax
+    }
+    return low
+}
+
+int main() {
+    *mut Point p = alloc(16)
+    p.x = 20
+    p.y = 22
+    *mut Point big = alloc(10000)
+    big.y = 1
+    mut int result = p.x + p.y + big.y - 1
+    result = result + misaligned(p) + misaligned(big) + misaligned(alloc(1))
+    free(p)
+    free(big)
+    *mut Point q = alloc(16)
+    q.y = 0
+    exit(result + q.y)
+}
+`)
+	if code != 42 {
+		t.Errorf("Expected heap program to exit with 42, got %v", code)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	asm, err := compile(t, `
+mut int counter = 5
+mut int[4] squares
+int seed = counter + 1
+
+int main() {
+    counter = seed
+    squares[counter] = 1
+    return counter
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"section .data", "__global_counter:\n\tdq 5", "section .bss", "__global_squares:\n\tresb 32", "mov QWORD [rel __global_counter], rax", "lea rdx, [rel __global_squares]", "call __init_globals\n\tcall _main"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	_, err = compile(t, `
+int x = 1
+
+int main() {
+    int x = 2
+    return x
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "already declared in global scope") {
+		t.Errorf("Expected global redeclaration error, got: %v", err)
+	}
+
+	// locals are declared once per function, whether again, as a parameter or in another match arm
+	for _, src := range []string{
+		"int main() {\n    mut int y = 1\n    mut char y = 'a'\n    return 0\n}\n",
+		"int f(int y) {\n    mut char y = 'a'\n    return 0\n}\n\nint main() {\n    return f(1)\n}\n",
+		"int main() {\n    match 1 {\n        0 => int y = 1\n        _ => char y = 'a'\n    }\n    return 0\n}\n",
+	} {
+		_, err = compile(t, src)
+		if err == nil || !strings.Contains(err.Error(), "Variable 'y' already declared in function") {
+			t.Errorf("Expected local redeclaration error, got: %v", err)
+		}
+	}
+
+	// the globals of the program are out of sight of modules, which can name locals after them
+	asm, err = compileProgram(t, map[string]string{
+		"main.pn": "import \"util\"\nmut int x = 1\n\nint main() {\n    return util.f() + x\n}\n",
+		"util.pn": "pub int f() {\n    mut int x = 2\n    return x\n}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if util := strings.Join(instructions(asm, "_util.f"), "\n"); strings.Contains(util, "__global_x") {
+		t.Errorf("Expected util.f to use its local x:\n%v", util)
+	}
+}
+
+func TestConstEvaluation(t *testing.T) {
+	asm, err := compile(t, `
+const int N = 4
+int SIZE = N * 2 + max(1, 3)
+
+int main() {
+    mut int[SIZE] buf
+    buf[0] = SIZE
+    exit(buf[0])
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"__global_SIZE:\n\tdq 11", "mov rax, 11", "sub rsp, 96"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	for src, want := range map[string]string{
+		"const int big = 9223372036854775807 + 1\n":      "overflows Int",
+		"const int n = 0\nconst int bad = 10 / n\n":      "Division by zero",
+		"const char c = 'z' + 200\n":                     "overflows Char",
+		"mut int n = 3\nint main() {\n    int[n] a\n}\n": "constant int expression",
+	} {
+		_, err = compile(t, src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error containing %q for:\n%v\ngot: %v", want, src, err)
+		}
+	}
+}
+
+func TestForwardReferences(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    Pair p = make(3)
+    exit(isEven(p.a))
+}
+
+int isEven(int n) {
+    match n {
+        0 => return 1
+        _ => return isOdd(n - 1)
+    }
+}
+
+int isOdd(int n) {
+    match n {
+        0 => return 0
+        _ => return isEven(n - 1)
+    }
+}
+
+Pair make(int n) {
+    return Pair { a: n, b: n }
+}
+
+struct Pair { int a  int b }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"call _isEven", "call _isOdd", "call _make"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	for _, src := range []string{"int main() {\n    missing(1)\n}\n", "int main() {\n    exit(missing(1) + 1)\n}\n"} {
+		_, err = compile(t, src)
+		if err == nil || !strings.Contains(err.Error(), "Undefined function 'missing'") {
+			t.Errorf("Expected undefined function error, got: %v", err)
+		}
+	}
+}
+
+func TestArgumentTypes(t *testing.T) {
+	for src, want := range map[string]string{
+		"int f(int c, int d, int e) {\n    return c\n}\n\nint main() {\n    exit(f('a', 2, 3))\n}\n": "Line 6: Argument 1 in call to 'f' has type Char, expected Int",
+		"int main() {\n    print(72)\n}\n":              "Line 2: Argument 1 in call to 'print' has type Int, expected Char",
+		"int main() {\n    int x = 1\n    free(x)\n}\n": "Argument 1 in call to 'free' has type Int, expected *mut Byte",
+	} {
+		_, err := compile(t, src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error containing %q for:\n%v\ngot: %v", want, src, err)
+		}
+	}
+
+	_, err := compile(t, `
+struct Node { int value }
+
+int main() {
+    *mut Node n = alloc(8)
+    free(n)
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Errorf("Expected pointer to convert to free's byte pointer parameter, got: %v", err)
+	}
+}
+
+func TestVoidFunctions(t *testing.T) {
+	asm, err := compile(t, `
+void greet(int n) {
+    match n {
+        0 => return
+        _ => print('!')
+    }
+}
+
+void main() {
+    greet(1)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(asm, "call _main\n\tmov rdi, 0") {
+		t.Errorf("Expected void main to exit with status 0:\n%v", asm)
+	}
+
+	for src, want := range map[string]string{
+		"void f() {\n    return\n}\n\nint main() {\n    exit(f())\n}\n": "Void function 'f' used as a value",
+		"int f() {\n    return\n}\n":                                    "Line 2: Missing return value in function 'f' returning Int",
+		"void f() {\n    return 1\n}\n":                                 "Line 2: Void function 'f' cannot return a value",
+		"int main() {\n    void x = 1\n}\n":                             "cannot have type Void",
+	} {
+		_, err = compile(t, src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error containing %q for:\n%v\ngot: %v", want, src, err)
+		}
+	}
+}
+
+func TestStackArguments(t *testing.T) {
+	asm, err := compile(t, `
+int sum(int a, int b, int c, int d, int e, int f, int g, int h) {
+    return a + b + c + d + e + f + g + h
+}
+
+int main() {
+    exit(sum(1, 2, 3, 4, 5, 6, 7, 8))
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"mov QWORD [rbp - 40], r8", "mov QWORD [rbp - 48], r9", "mov rbx, QWORD [rbp + 24]", "pop r9\n\tpop r8", "call _sum\n\tadd rsp, 16"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	// weighting the last arguments checks each lands in its own parameter
+	code, _ := runProgram(t, `
+int sum(int a, int b, int c, int d, int e, int f, int g, int h) {
+    return a + b + c + d + e + f + g * 10 + h * 100
+}
+
+int main() {
+    return sum(1, 2, 3, 4, 5, 6, 7, 1)
+}
+`)
+	if code != 191 {
+		t.Errorf("Expected stack arguments to sum to 191, got %v", code)
+	}
+}
+
+func TestExternCalls(t *testing.T) {
+	asm, err := compile(t, `
+extern int puts(*char s)
+
+mut char[3] msg = ['o', 'k']
+
+int main() {
+    puts(&msg[0])
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"global main\nextern exit\nextern puts\n", "xor eax, eax\n\tcall puts", "and rsp, -16\n\tcall exit", "main:\n\tsub rsp, 8\n\tcall _main"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	// only the fixed parameters of variadic functions are checked
+	asm, err = compile(t, `
+extern int printf(*char fmt, ...)
+
+mut char[4] format = ['%', 'd', '%', 'c']
+
+int main() {
+    printf(&format[0], 42, 'x')
+    printf(&format[0])
+    exit(0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(asm, "xor eax, eax\n\tcall printf") {
+		t.Errorf("Expected a variadic call to printf:\n%v", asm)
+	}
+
+	_, err = compile(t, `
+extern int printf(*char fmt, ...)
+
+int main() {
+    printf()
+    exit(0)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "Expected at least 1 args, got 0") {
+		t.Errorf("Expected argument count error, got: %v", err)
+	}
+
+	_, err = compile(t, `
+extern int printf(..., *char fmt)
+`)
+	if err == nil || !strings.Contains(err.Error(), "Expected ')' after '...'") {
+		t.Errorf("Expected error for '...' before a parameter, got: %v", err)
+	}
+
+	_, err = compile(t, `
+struct Point { int x  int y }
+extern int draw(Point p)
+`)
+	if err == nil || !strings.Contains(err.Error(), "cannot take struct parameter 'p'") {
+		t.Errorf("Expected struct parameter error, got: %v", err)
+	}
+}
+
+func TestExports(t *testing.T) {
+	asm, err := compile(t, `
+mut int calls = 0
+
+export int scale(int a, int b) {
+    calls++
+    return a * b
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"global scale\n", "scale:\n", "mov QWORD [rbp - 24], rbx", "mov rbx, QWORD [rbp - 24]\n\tmov rsp, rbp"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+	if strings.Contains(asm, "_start") {
+		t.Errorf("Expected no entry point in a library:\n%v", asm)
+	}
+
+	funcs := semantics.FuncMap{
+		"scale": {Type: semantics.Int, Signature: "scale", Exported: true, Params: []semantics.Param{{Name: "a", Type: semantics.Int}, {Name: "s", Type: semantics.PointerTo(semantics.Char, false)}}},
+		"reset": {Type: semantics.Void, Signature: "reset", Exported: true},
+		"_main": {Type: semantics.Int, Signature: "_main"},
+	}
+
+	var header strings.Builder
+	err = generator.GenerateHeader("my-lib", &funcs, &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"#ifndef PENGUIN_MY_LIB_H\n", "void reset(void);\nlong scale(long a, const char *s);\n"} {
+		if !strings.Contains(header.String(), want) {
+			t.Errorf("Expected %q in generated header:\n%v", want, header.String())
+		}
+	}
+
+	_, err = compile(t, `
+struct Point { int x  int y }
+export int length(Point p) {
+    return p.x
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "cannot take struct parameter 'p'") {
+		t.Errorf("Expected struct parameter error, got: %v", err)
+	}
+}
+
+// instructions returns the lines of the function labelled name, without comments or indentation
+func instructions(asm string, name string) []string {
+	start := strings.Index(asm, "\n"+name+":\n")
+	if start < 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, line := range strings.Split(asm[start+len(name)+3:], "\n") {
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		// the next function, or a section after the last one, ends it
+		if strings.HasSuffix(line, ":") && !strings.HasPrefix(line, ".") || strings.HasPrefix(line, "section") {
+			break
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// checkSaved checks that function name stores reg in its frame before using it and reloads it on return
+func checkSaved(t *testing.T, asm string, name string, reg string) {
+	t.Helper()
+
+	lines := instructions(asm, name)
+	slot := ""
+	for _, line := range lines {
+		if strings.HasPrefix(line, "mov QWORD [rbp - ") && strings.HasSuffix(line, "], "+reg) {
+			slot = strings.TrimSuffix(strings.TrimPrefix(line, "mov "), ", "+reg)
+			break
+		}
+
+		if strings.Contains(line, reg) {
+			t.Errorf("Expected %v to save %v before %q:\n%v", name, reg, line, strings.Join(lines, "\n"))
+			return
+		}
+	}
+	if slot == "" {
+		t.Errorf("Expected %v to save %v:\n%v", name, reg, strings.Join(lines, "\n"))
+		return
+	}
+
+	returned := false
+	for _, line := range lines {
+		if line == ".return:" {
+			returned = true
+		} else if returned && line == "mov "+reg+", "+slot {
+			return
+		} else if line == "ret" {
+			break
+		}
+	}
+	t.Errorf("Expected %v to restore %v from %v before ret:\n%v", name, reg, slot, strings.Join(lines, "\n"))
+}
+
+func TestCalleeSavedRegisters(t *testing.T) {
+	asm, err := compile(t, `
+int id(int a) {
+    return a
+}
+
+int add(int a, int b) {
+    return a + b
+}
+
+int main() {
+    return add(id(1), 2)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSaved(t, asm, "_add", "rbx")
+
+	// functions that never write rbx leave it alone
+	if id := strings.Join(instructions(asm, "_id"), "\n"); strings.Contains(id, "rbx") {
+		t.Errorf("Expected _id not to save rbx:\n%v", id)
+	}
+}
+
+func TestInlineAsm(t *testing.T) {
+	asm, err := compile(t, `
+mut int total = 0
+
+int main() {
+    mut int x = 10
+    asm {
+        mov rax, {x}
+    .loop:
+        add {total}, rax
+        xor ebx, ebx
+    }
+    return total
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"\tmov rax, QWORD [rbp - 8]\n.loop:\n\tadd QWORD [rel __global_total], rax\n\txor ebx, ebx\n", "mov rbx, QWORD [rbp - 16]\n\tmov rsp, rbp"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	_, err = compile(t, `
+int main() {
+    asm {
+        mov rax, {y}
+    }
+    return 0
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "Line 3: Undefined variable 'y' in asm block") {
+		t.Errorf("Expected undefined variable error, got: %v", err)
+	}
+}
+
+func TestInlineAsmCalleeSaved(t *testing.T) {
+	asm, err := compile(t, `
+int f(int a) {
+    asm {
+        mov r12, {a}
+        add r12w, 1
+    }
+    return a
+}
+
+int main() {
+    return f(1)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSaved(t, asm, "_f", "r12")
+
+	if f := strings.Join(instructions(asm, "_f"), "\n"); strings.Contains(f, "r13") || strings.Contains(f, "rbx") {
+		t.Errorf("Expected _f to save only r12:\n%v", f)
+	}
+}
+
+func TestSyscall(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    return syscall(9, 0, 4096, 3, 34, 0 - 1, 0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "\tpop r9\n\tpop r8\n\tpop r10\n\tpop rdx\n\tpop rsi\n\tpop rdi\n\tpop rax\n\tsyscall\n"
+	if !strings.Contains(asm, want) {
+		t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+	}
+
+	_, err = compile(t, `
+int main() {
+    return syscall(1, 2, 3, 4, 5, 6, 7, 8)
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "Expected 1 to 7 args, got 8") {
+		t.Errorf("Expected argument count error, got: %v", err)
+	}
+
+	// write returns the bytes written, then exit ends the program with a status built from it
+	code, out := runProgram(t, `
+int main() {
+    mut char[] msg = ['h', 'i', '\n']
+    int written = syscall(1, 1, &msg[0], 3)
+    return syscall(60, written + 4)
+}
+`)
+	if code != 7 || out != "hi\n" {
+		t.Errorf("Expected syscalls to print hi and exit with 7, got %v and %q", code, out)
+	}
+}
+
+func TestRepeatedCompiles(t *testing.T) {
+	// every compilation declares the types of the standard library again
+	for i := 0; i < 2; i++ {
+		vars := make(semantics.VarMap)
+		funcs := make(semantics.FuncMap)
+		if err := generator.DeclareBuiltins(generator.NewRegistry(), &funcs); err != nil {
+			t.Fatal(err)
+		}
+
+		std.Load(&vars, &funcs)
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	builtins := generator.NewRegistry()
+	err := builtins.Register(generator.Builtin{
+		Signature: "twice(int)",
+		Returns:   "int",
+		Fold: func(args []int) (int, error) {
+			return 2 * args[0], nil
+		},
+		Gen: func(to generator.Register, node parser.ASTNode, genData *generator.GeneratorData) error {
+			err := genData.GenArg(generator.RAX, node.Children[0])
+			if err != nil {
+				return err
+			}
+
+			return genData.Emit("add rax, rax")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asm, err := compileWith(t, map[string]string{"main.pn": `
+int[twice(2)] xs
+
+int main() {
+    mut int n = 3
+    return twice(n)
+}
+`}, builtins, generator.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"\tmov rax, QWORD [rbp - 8]\n\tadd rax, rax\n", "resb 32"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	err = builtins.Register(generator.Builtin{Signature: "twice(int)", Returns: "int", Label: "twice"})
+	if err == nil || !strings.Contains(err.Error(), "Builtin 'twice' already registered") {
+		t.Errorf("Expected duplicate builtin error, got: %v", err)
+	}
+
+	// other compilations only see the standard builtins
+	if _, err := compile(t, "int main() {\n    return twice(1)\n}\n"); err == nil {
+		t.Errorf("Expected builtin 'twice' to stay in its registry")
+	}
+}
+
+func TestShadowBuiltins(t *testing.T) {
+	// abs, min and max belong to the standard library, so programs can use the names
+	asm, err := compile(t, `
+extern int abs(int x)
+
+int max(int a, int b) {
+    return a - b
+}
+
+int[min(2, 3)] xs
+
+int main() {
+    mut char line = ' '
+    return max(abs(0 - 3), 1) + read_line(&line, 0)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"call abs", "call _max", "resb 16", "cmovl"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	asm, err := compile(t, `
+int main() {
+    printint(gcd(12, 18))
+    return 0
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"_std.printint:\n", "_std.printdigits:\n", "_std.gcd:\n", "call _std.printint"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	// library functions the program never reaches are left out
+	for _, unwanted := range []string{"_std.power:", "_std.strlength:", "_std.memcopy:"} {
+		if strings.Contains(asm, unwanted) {
+			t.Errorf("Expected no %q in generated assembly:\n%v", unwanted, asm)
+		}
+	}
+
+	// parameters of library functions do not clash with globals of the same name
+	asm, err = compile(t, `
+mut int n = 3
+
+int main() {
+    printint(n)
+    return n
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"\tmov QWORD [rbp - 8], rdi\n\tmov rax, QWORD [rbp - 8]\n", "mov rax, QWORD [rel __global_n]\n\tjmp .return"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+	// strings longer than the stack could hold a frame per char for are compared in a loop
+	code, _ := runProgram(t, `
+int main() {
+    *mut char a = alloc(200001)
+    *mut char b = alloc(200001)
+    memfill(a, 'x', 200000)
+    memfill(b, 'x', 200000)
+    *(a + 200000) = '\x00'
+    *(b + 200000) = '\x00'
+    mut char[] short = ['x', 'x', '\x00']
+    mut char[] empty = ['\x00']
+    int same = strequal(a, b)
+    *(b + 199999) = 'y'
+    int differ = strequal(a, b)
+    int prefix = strequal(a, &short[0])
+    int nothing = strequal(&empty[0], &empty[0])
+    return same * 100 + differ * 50 + prefix * 10 + nothing
+}
+`)
+	if code != 101 {
+		t.Errorf("Expected strequal to tell only equal strings apart, got exit code %v", code)
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	asm, err := compile(t, `
+mut char[16] line
+
+int main() {
+    mut int n = 0
+    mut char c = ' '
+    int sign = read_int(&n)
+    match read_char(&c) {
+        0 => return 0
+        _ => return read_line(&line[0], 16) + sign
+    }
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"_std.read_int:\n", "_std.read_char:\n", "_std.read_line:\n", "call _std.read_int", "_std.ord:\n"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	// variables may share a name with a library function, which is only called when followed by '('
+	if strings.Contains(asm, "call _std.sign") {
+		t.Errorf("Expected 'sign' to be read as a variable:\n%v", asm)
+	}
+
+	code, out := runProgramInput(t, `
+int main() {
+    mut int n = 0
+    mut char[8] line
+    int got = read_int(&n)
+    int length = read_line(&line[0], 8)
+    printstr(&line[0])
+    return 0 - n + length + got
+}
+`, strings.NewReader("  -42 rest\nnext"))
+	if code != 48 || out != "rest" {
+		t.Errorf("Expected to read -42 and the line rest, got %v and %q", code, out)
+	}
+
+	// the end of the input reads as 0 and a failing read as its negative error code
+	failing := `
+int main() {
+    mut int n = 0
+    mut char[8] line
+    int length = read_line(&line[0], 8)
+    int got = read_int(&n)
+    return (0 - length) * 10 + 0 - got
+}
+`
+	if code, _ := runProgramInput(t, failing, strings.NewReader("")); code != 0 {
+		t.Errorf("Expected reads at the end of the input to return 0, got %v", code)
+	}
+
+	// reading a file opened only for writing fails with EBADF
+	stdin, err := os.OpenFile(filepath.Join(t.TempDir(), "input"), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+
+	if code, _ := runProgramInput(t, failing, stdin); code != 99 {
+		t.Errorf("Expected failing reads to return -9, got exit code %v", code)
+	}
+}
+
+func TestFileIO(t *testing.T) {
+	asm, err := compile(t, `
+mut char[3] path = ['o', 'k', '\x00']
+mut char[16] line
+
+int main() {
+    int fd = open_read(&path[0])
+    mut Reader r = reader_open(fd, 64)
+    int n = reader_line(&r, &line[0], 16)
+    reader_free(&r)
+
+    mut Writer w = writer_open(1, 64)
+    writer_str(&w, &line[0])
+    writer_free(&w)
+
+    close(fd)
+    return min(unlink(&path[0]), n)
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"_std.reader_fill:\n", "_std.write_all:\n", "_std.open:\n", "_std.unlink:\n", "call __alloc", "call __free"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	if strings.Contains(asm, "_std.seek:") {
+		t.Errorf("Expected unused seek to be left out:\n%v", asm)
+	}
+}
+
+func TestFileIORun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines")
+
+	chars := []string{}
+	for _, c := range path {
+		chars = append(chars, fmt.Sprintf("'%c'", c))
+	}
+
+	code, out := runProgram(t, `
+mut char[] path = [`+strings.Join(chars, ", ")+`, '\x00']
+mut char[] text = ['h', 'i', '\n', 'y', 'o', '\n', '\x00']
+mut char[16] line
+
+int main() {
+    int fd = open_write(&path[0])
+    mut Writer w = writer_open(fd, 4)
+    writer_str(&w, &text[0])
+    writer_free(&w)
+    close(fd)
+
+    // skips the first line
+    int input = open_read(&path[0])
+    seek(input, 3, 0)
+    mut Reader r = reader_open(input, 64)
+    reader_line(&r, &line[0], 16)
+    reader_free(&r)
+    close(input)
+
+    mut Writer out = writer_open(1, 64)
+    writer_str(&out, &line[0])
+    writer_free(&out)
+
+    unlink(&path[0])
+    mut Reader closed = reader_open(input, 64)
+    int failed = reader_line(&closed, &line[0], 16)
+    reader_free(&closed)
+    int missing = unlink(&path[0])
+    return 0 - failed * 10 - missing
+}
+`)
+	if out != "yo" {
+		t.Errorf("Expected the second line to be read back, got %q", out)
+	}
+
+	// EBADF from reading a line of the closed file, ENOENT from unlinking it twice
+	if code != 92 {
+		t.Errorf("Expected exit code 92 from the failing calls, got %v", code)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected %v to be unlinked, got %v", path, err)
+	}
+}
+
+func TestFileLongLines(t *testing.T) {
+	// a line far longer than both buffers is copied in chunks, not a call per char
+	input := strings.Repeat("x", 200000) + "\n"
+	code, out := runProgramInput(t, `
+int main() {
+    *mut char line = alloc(200002)
+    mut Reader r = reader_open(0, 64)
+    int n = reader_line(&r, line, 200002)
+    reader_free(&r)
+
+    mut Writer w = writer_open(1, 64)
+    writer_str(&w, line)
+    writer_free(&w)
+
+    return n - 199900
+}
+`, strings.NewReader(input))
+	if code != 101 {
+		t.Errorf("Expected the line of 200001 chars to be read, exit code %v", code)
+	}
+
+	if out != strings.TrimSuffix(input, "\n") {
+		t.Errorf("Expected the line to be written back, got %v chars", len(out))
+	}
+}
+
+func TestModules(t *testing.T) {
+	asm, err := compileProgram(t, map[string]string{
+		"main.pn": `
+import "geo/shapes"
+
+mut int count = 0
+
+int area(int n) {
+    return n
+}
+
+int main() {
+    mut shapes.Rect r = shapes.square(3)
+    count++
+    return shapes.area(&r) + area(count)
+}
+`,
+		"geo/shapes.pn": `
+import "geo/units"
+
+mut int count = 0
+
+pub struct Rect {
+    int w
+    int h
+}
+
+pub int area(*Rect r) {
+    count++
+    return units.scale(r.w) * r.h
+}
+
+pub Rect square(int n) {
+    return Rect { w: n, h: n }
+}
+`,
+		"geo/units.pn": `
+pub int scale(int n) {
+    return n * 2
+}
+`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// functions and globals of a module are named after its path, so they do not clash with the program's
+	for _, want := range []string{"_geo.shapes.area:\n", "_area:\n", "call _geo.units.scale", "__global_geo.shapes.count:\n", "__global_count:\n"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("Expected %q in generated assembly:\n%v", want, asm)
+		}
+	}
+
+	for _, test := range []struct {
+		files map[string]string
+		want  string
+	}{
+		{map[string]string{"main.pn": "import \"lib\"\nint main() {\n    return lib.hidden()\n}\n", "lib.pn": "int hidden() {\n    return 1\n}\n"}, "Function 'hidden' is private to module 'lib'"},
+		{map[string]string{"main.pn": "import \"lib\"\nint main() {\n    mut lib.Pair p = lib.Pair { a: 1 }\n    return 0\n}\n", "lib.pn": "struct Pair { int a }\n"}, "Type Pair is private to module 'lib'"},
+		{map[string]string{"main.pn": "import \"lib\"\nint helper() {\n    return 1\n}\n", "lib.pn": "int f() {\n    return helper()\n}\n"}, "Undefined function 'helper'"},
+		{map[string]string{"main.pn": "import \"lib\"\n", "lib.pn": "import \"main\"\n"}, "Import cycle through module 'main'"},
+	} {
+		_, err := compileProgram(t, test.files)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Expected error containing %q, got: %v", test.want, err)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		project.Filename: `{"entry": "src/main.pn", "sources": ["src", "lib"], "output": "bin/app", "libs": ["m"]}`,
+		"src/main.pn":    "import \"util\"\nint main() {\n    return util.twice(4)\n}\n",
+		"lib/util.pn":    "pub int twice(int n) {\n    return n * 2\n}\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the project file is found from any directory below it
+	path, err := project.Find(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proj, err := project.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proj.Entry != filepath.Join(dir, "src", "main.pn") || proj.Output != filepath.Join(dir, "bin", "app") || len(proj.Sources) != 2 || proj.Sources[1] != filepath.Join(dir, "lib") {
+		t.Errorf("Expected paths relative to the project file, got %+v", proj)
+	}
+
+	dat, err := os.ReadFile(proj.Entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := make(semantics.VarMap)
+	funcs := make(semantics.FuncMap)
+	if err := generator.DeclareBuiltins(generator.NewRegistry(), &funcs); err != nil {
+		t.Fatal(err)
+	}
+	module.Load(proj.Entry, proj.Sources, tokenizer.Tokenize(dat), &vars, &funcs)
+
+	if _, ok := funcs["util.twice"]; !ok {
+		t.Errorf("Expected module util to be found in the second source directory")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"entry": "src/main.pn", "source": ["src"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := project.Load(path); err == nil || !strings.Contains(err.Error(), `unknown field "source"`) {
+		t.Errorf("Expected unknown field error, got: %v", err)
+	}
+
+	// the output directory keeps the name of the executable
+	if err := os.WriteFile(path, []byte(`{"entry": "src/main.pn", "output": "bin/app", "out_dir": "build"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if proj, err := project.Load(path); err != nil || proj.Output != filepath.Join(dir, "build", "app") {
+		t.Errorf("Expected output in the out_dir, got %+v, %v", proj, err)
+	}
+}